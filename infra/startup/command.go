@@ -0,0 +1,264 @@
+package startup
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// commands 子命令，第一个参数匹配时执行对应命令而不启动服务
+var commands = map[string]func(args []string) error{
+	"build-pwned-filter": buildPwnedFilterCommand,
+	"check-config":       checkConfigCommand,
+	"migrate":            migrateCommand,
+	"rotate-secret":      rotateSecretCommand,
+}
+
+// runCommand 执行子命令，第一个参数不是子命令时返回 false
+func runCommand() (bool, error) {
+	if len(os.Args) < 2 {
+		return false, nil
+	}
+	if os.Args[1] == "help" {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Println("Commands:")
+		for _, name := range names {
+			fmt.Println("  " + name)
+		}
+		return true, nil
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd(os.Args[2:])
+}
+
+// buildPwnedFilterCommand 从 HIBP 哈希文件生成布隆过滤器
+func buildPwnedFilterCommand(args []string) error {
+	fs := flag.NewFlagSet("build-pwned-filter", flag.ExitOnError)
+	input := fs.String("input", "", "HIBP SHA-1 hash file (SHA1:COUNT per line)")
+	output := fs.String("output", "pwned.bloom", "Bloom filter output path")
+	fpRate := fs.Float64("fp", 0.001, "False positive rate")
+	fs.Parse(args)
+	if *input == "" {
+		return errors.New("-input is required")
+	}
+	if *fpRate <= 0 || *fpRate >= 1 {
+		return errors.New("-fp must be between 0 and 1")
+	}
+	filter, err := utils.BuildBloomFilter(*input, *fpRate)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	size, err := filter.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Bloom filter written to %s (%d bytes)", *output, size)
+	return nil
+}
+
+// checkConfigCommand 检查配置文件，列出所有问题，存在问题时以非零状态退出
+func checkConfigCommand(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := fs.String("config", "config.json", "Config file path (JSON, YAML or TOML)")
+	fs.Parse(args)
+
+	conf, err := readConfig(*configFile)
+	if err != nil {
+		problems := flattenErrors(err)
+		for _, e := range problems {
+			logrus.Errorln(e)
+		}
+		return fmt.Errorf("%d problems found in %s", len(problems), *configFile)
+	}
+	overridden := make([]string, 0, len(conf.EnvOverrides))
+	for path := range conf.EnvOverrides {
+		overridden = append(overridden, path)
+	}
+	sort.Strings(overridden)
+	for _, path := range overridden {
+		logrus.Infof("%s is overridden by environment variable", path)
+	}
+	logrus.Infof("Config %s OK", *configFile)
+	return nil
+}
+
+// flattenErrors 展开 errors.Join 合并的错误
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
+
+// migrateCommand 将配置文件或 user_file 中的用户、管理接口密钥和会话状态导入 SQLite 数据库
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFile := fs.String("config", "config.json", "Config file path (JSON, YAML or TOML)")
+	dbPath := fs.String("database", "", "SQLite database path, defaults to database.path in config")
+	updateConfig := fs.Bool("update-config", false, "Remove migrated data from config and enable the database")
+	fs.Parse(args)
+
+	conf, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	// 用户存储按当前配置的密钥计算密码指纹，-update-config 只写入相对读取时修改的字段
+	vars.SetConfig(conf)
+	if *dbPath == "" {
+		*dbPath = conf.Database.Path
+	}
+	if *dbPath == "" {
+		return errors.New("-database is required")
+	}
+	migrated, source, err := migrationUsers(conf, *configFile)
+	if err != nil {
+		return err
+	}
+	store, err := utils.NewSQLiteStore(vars.Database{Path: *dbPath})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// 数据库中已存在的同名用户会被迁移的用户覆盖
+	err = store.Users.Update(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		for _, u := range migrated {
+			if idx := slices.IndexFunc(users, func(item vars.UserItem) bool { return item.Username == u.Username }); idx >= 0 {
+				users[idx] = u
+			} else {
+				users = append(users, u)
+			}
+		}
+		return users, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range conf.AdminAPI.Keys {
+		if err := store.APIKeys.AddAPIKey(item); err != nil {
+			return err
+		}
+	}
+	sessionCount := 0
+	if conf.SessionState != "" {
+		sessions := utils.NewMemorySessionStore()
+		if err := sessions.LoadState(conf.SessionState); err != nil {
+			return err
+		}
+		for _, session := range sessions.List("") {
+			store.Sessions.Create(session)
+			sessionCount++
+		}
+	}
+	logrus.Infof("Migrated %d users from %s, %d api keys and %d sessions to %s", len(migrated), source, len(conf.AdminAPI.Keys), sessionCount, *dbPath)
+
+	if *updateConfig {
+		conf.Users = nil
+		conf.UserFile = vars.UserFile{}
+		conf.AdminAPI.Keys = nil
+		conf.SessionState = ""
+		conf.Database.Path = *dbPath
+		vars.ConfigPath = *configFile
+		if err := utils.SaveConfig(conf); err != nil {
+			return err
+		}
+		logrus.Infof("Config %s updated to use the database", *configFile)
+	}
+	return nil
+}
+
+// migrationUsers 返回需要迁移的用户和来源，配置了 user_file 时从用户文件读取
+// 用户文件中无法识别的密码格式在数据库中会按明文比较，不迁移这些用户
+func migrationUsers(conf vars.ConfigFile, configFile string) ([]vars.UserItem, string, error) {
+	if conf.UserFile.Path == "" {
+		return conf.Users, configFile, nil
+	}
+	fileStore, err := utils.NewFileUserStore(conf.UserFile)
+	if err != nil {
+		return nil, "", err
+	}
+	var users []vars.UserItem
+	for _, u := range fileStore.List() {
+		if !utils.IsPasswordHash(u.Password) {
+			logrus.Warnf("Skip %s: password is not a supported hash, prefix plaintext passwords with {PLAIN}", u.Username)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, conf.UserFile.Path, nil
+}
+
+// rotateSecretCommand 生成新的 secret，原 secret 移入 previous_secrets 并在宽限期后失效
+// 同时清理已过宽限期的旧密钥，服务需要重新加载配置后生效
+func rotateSecretCommand(args []string) error {
+	fs := flag.NewFlagSet("rotate-secret", flag.ExitOnError)
+	configFile := fs.String("config", "config.json", "Config file path (JSON, YAML or TOML)")
+	grace := fs.Duration("grace", 30*24*time.Hour, "How long tokens signed with the old secret stay valid")
+	newSecret := fs.String("secret", "", "New secret, a random one is generated if empty")
+	fs.Parse(args)
+	if *grace <= 0 {
+		return errors.New("-grace must be positive")
+	}
+
+	conf, err := readConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	base := conf
+	if _, ok := conf.EnvOverrides["secret"]; ok || utils.IsSecretRef(conf, "secret", conf.Secret) {
+		return errors.New("secret is loaded from an environment variable or file, update it there and add the old one to previous_secrets")
+	}
+	if *newSecret == "" {
+		*newSecret = utils.RandToken()
+	}
+	if *newSecret == conf.Secret {
+		return errors.New("new secret is the same as the current one")
+	}
+	now := time.Now()
+	previous := []vars.PreviousSecret{{Secret: conf.Secret, ExpiresAt: now.Add(*grace).Truncate(time.Second)}}
+	oldIndex := []int{-1}
+	for i, p := range conf.PreviousSecrets {
+		if p.Secret != *newSecret && (p.ExpiresAt.IsZero() || now.Before(p.ExpiresAt)) {
+			previous = append(previous, p)
+			oldIndex = append(oldIndex, i)
+		}
+	}
+	oldKID := utils.SecretKeyID(conf.Secret)
+	conf.Secret = *newSecret
+	conf.PreviousSecrets = previous
+	conf.SecretRefs = utils.RemapSecretRefs(conf.SecretRefs, "previous_secrets", "secret", oldIndex)
+	vars.ConfigPath = *configFile
+	if err := utils.SaveConfigFrom(base, conf); err != nil {
+		return err
+	}
+	logrus.Infof("Secret rotated in %s, kid %s -> %s, old secret valid until %s", *configFile, oldKID, utils.SecretKeyID(conf.Secret), previous[0].ExpiresAt.Format(time.RFC3339))
+	logrus.Infoln("Reload the config (SIGHUP or /api/v1/config/reload) to apply")
+	return nil
+}
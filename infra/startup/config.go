@@ -0,0 +1,310 @@
+package startup
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// readConfig 读取配置文件，应用环境变量覆盖并填充默认值，返回配置和文件原始内容
+// 支持 JSON、YAML 和 TOML，配置中的所有问题一次性返回
+func readConfig(path string) (vars.ConfigFile, error) {
+	bConf, err := os.ReadFile(path)
+	if err != nil {
+		return vars.ConfigFile{}, err
+	}
+	conf, problems, err := utils.DecodeConfig(path, bConf)
+	if err != nil {
+		return conf, err
+	}
+	if err := utils.ResolveConfigSecrets(&conf); err != nil {
+		return conf, err
+	}
+	if hasInlineSecrets(conf) {
+		utils.WarnWorldReadable(path)
+	}
+	if conf.Listen == "" {
+		conf.Listen = "127.0.0.1:9008"
+	}
+	if conf.Redirect == "" {
+		conf.Redirect = "http://127.0.0.1:9008"
+	}
+	if conf.LogLevel == "" {
+		conf.LogLevel = "info"
+	}
+	if conf.Jail.Enabled {
+		if conf.Jail.MaxAttempts == 0 {
+			conf.Jail.MaxAttempts = 5
+		}
+		if conf.Jail.BanDuration == 0 {
+			conf.Jail.BanDuration = 300
+		}
+	}
+	if conf.AuthCache.Enabled {
+		if conf.AuthCache.TTL == 0 {
+			conf.AuthCache.TTL = 5
+		}
+		if conf.AuthCache.Size == 0 {
+			conf.AuthCache.Size = 8
+		}
+	}
+	if err := validateConfig(conf); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 {
+		return conf, errors.Join(problems...)
+	}
+	conf.Hash = hex.EncodeToString(utils.SHA256(bConf))
+	return conf, nil
+}
+
+// validateConfig 检查填充默认值后的配置，返回所有发现的问题
+func validateConfig(conf vars.ConfigFile) error {
+	var problems []error
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	if u, err := url.Parse(conf.Redirect); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("redirect must be an absolute http(s) URL, got %q", conf.Redirect)
+	}
+	if conf.ListenMode != "" {
+		if _, err := strconv.ParseUint(conf.ListenMode, 8, 32); err != nil {
+			add("listen_mode must be an octal file mode, got %q", conf.ListenMode)
+		}
+	}
+	if _, err := logrus.ParseLevel(conf.LogLevel); err != nil {
+		add("log_level: %v", err)
+	}
+	if conf.Secret == "" {
+		add("secret is required")
+	}
+	if conf.Jail.MaxAttempts < 0 || conf.Jail.BanDuration < 0 {
+		add("jail.max_attempts and jail.ban_duration must not be negative")
+	}
+	if conf.AuthCache.TTL < 0 || conf.AuthCache.Size < 0 {
+		add("auth_cache.ttl and auth_cache.size must not be negative")
+	}
+	if conf.ShutdownTimeout < 0 {
+		add("shutdown_timeout must not be negative")
+	}
+	for _, domain := range conf.TrustedDomains {
+		if domain == "" || strings.Contains(domain, "/") {
+			add("trusted_domains: %q must be a domain name without scheme or path", domain)
+		}
+	}
+	if (conf.TLS.CertFile == "") != (conf.TLS.KeyFile == "") {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	if conf.TLS.ACME.Enabled && len(conf.TLS.ACME.Domains) == 0 {
+		add("tls.acme.domains is required when acme is enabled")
+	}
+	switch strings.ToLower(conf.UserFile.Format) {
+	case "", utils.UserFileHtpasswd, utils.UserFileYAML, utils.UserFileJSON, utils.UserFileCSV:
+	default:
+		add("unsupported user_file.format %q", conf.UserFile.Format)
+	}
+	if conf.UserFile.Path != "" && conf.Database.Path != "" {
+		add("database and user_file cannot be used together")
+	}
+	seen := make(map[string]bool)
+	for i, u := range conf.Users {
+		if u.Username == "" {
+			add("users[%d].username is required", i)
+		} else if seen[u.Username] {
+			add("users[%d]: duplicate username %q", i, u.Username)
+		}
+		seen[u.Username] = true
+	}
+	for i, k := range conf.AdminAPI.Keys {
+		if k.Key == "" {
+			add("admin_api.keys[%d].key is required", i)
+		}
+	}
+	clientIDs := make(map[string]bool)
+	for i, cl := range conf.Introspection.Clients {
+		if cl.ClientID == "" || cl.ClientSecret == "" {
+			add("introspection.clients[%d]: client_id and client_secret are required", i)
+		} else if clientIDs[cl.ClientID] {
+			add("introspection.clients[%d]: duplicate client_id %q", i, cl.ClientID)
+		}
+		clientIDs[cl.ClientID] = true
+	}
+	if algorithm := conf.PasswordHash.Algorithm; algorithm != "" && !slices.Contains(utils.PasswordHashAlgorithms, algorithm) {
+		add("unsupported password_hash.algorithm %q", algorithm)
+	}
+	if conf.Session.IdleTimeout < 0 || conf.Session.MaxLifetime < 0 {
+		add("session.idle_timeout and session.max_lifetime must not be negative")
+	}
+	for i, p := range conf.Session.Policies {
+		if len(p.Users) == 0 && len(p.Groups) == 0 && len(p.Hosts) == 0 {
+			add("session.policies[%d] must set users, groups or hosts", i)
+		}
+	}
+	if err := validateSessionDurations(conf.Session); err != nil {
+		problems = append(problems, err)
+	}
+	if conf.Proxy.BodyLimit < 0 {
+		add("proxy.body_limit must not be negative")
+	}
+	authHost := ""
+	if u, err := url.Parse(conf.Redirect); err == nil {
+		authHost = u.Hostname()
+	}
+	proxyHosts := make(map[string]bool)
+	for i, route := range conf.Proxy.Routes {
+		host := strings.ToLower(route.Host)
+		switch {
+		case host == "" || strings.ContainsAny(host, ":/"):
+			add("proxy.routes[%d].host must be a domain name without scheme, port or path", i)
+		case proxyHosts[host]:
+			add("proxy.routes[%d]: duplicate host %q", i, route.Host)
+		case strings.EqualFold(host, authHost):
+			add("proxy.routes[%d]: host %q is the host of redirect", i, route.Host)
+		}
+		proxyHosts[host] = true
+		if u, err := url.Parse(route.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			add("proxy.routes[%d].upstream must be an absolute http(s) URL without query, got %q", i, route.Upstream)
+		}
+	}
+	if p := conf.CrossDomain.CallbackPath; p != "" && !strings.HasPrefix(p, "/") {
+		add("cross_domain.callback_path must start with /")
+	}
+	if p := conf.Cookie.Path; p != "" && !strings.HasPrefix(p, "/") {
+		add("cookie.path must start with /")
+	}
+	if err := validateCookie(conf.Cookie); err != nil {
+		problems = append(problems, err)
+	}
+	return errors.Join(problems...)
+}
+
+// hasInlineSecrets 判断配置文件中是否直接保存了密钥、管理接口密钥或用户密码
+func hasInlineSecrets(conf vars.ConfigFile) bool {
+	if conf.Secret != "" && !utils.IsSecretRef(conf, "secret", conf.Secret) {
+		return true
+	}
+	for i, k := range conf.AdminAPI.Keys {
+		if !utils.IsSecretRef(conf, utils.SecretRefPath("admin_api.keys", i, "key"), k.Key) {
+			return true
+		}
+	}
+	for i, cl := range conf.Introspection.Clients {
+		if !utils.IsSecretRef(conf, utils.SecretRefPath("introspection.clients", i, "client_secret"), cl.ClientSecret) {
+			return true
+		}
+	}
+	for i, u := range conf.Users {
+		if !utils.IsSecretRef(conf, utils.SecretRefPath("users", i, "password"), u.Password) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCookie 检查 Cookie 设置是否会被浏览器拒绝
+func validateCookie(conf vars.CookieConfig) error {
+	switch strings.ToLower(conf.SameSite) {
+	case "", "lax", "strict", "none":
+	default:
+		return fmt.Errorf("unsupported cookie.same_site %q", conf.SameSite)
+	}
+	secureDisabled := conf.Secure != nil && !*conf.Secure
+	if strings.HasPrefix(conf.Name, "__Host-") {
+		if conf.Domain != "" {
+			return errors.New("cookie.domain must be empty for __Host- cookies")
+		}
+		if conf.Path != "" && conf.Path != "/" {
+			return errors.New("cookie.path must be / for __Host- cookies")
+		}
+	}
+	if secureDisabled {
+		if strings.HasPrefix(conf.Name, "__Host-") || strings.HasPrefix(conf.Name, "__Secure-") {
+			return fmt.Errorf("cookie.secure cannot be disabled for %s", conf.Name)
+		}
+		if strings.EqualFold(conf.SameSite, "none") {
+			return errors.New("cookie.secure cannot be disabled when cookie.same_site is None")
+		}
+	}
+	return nil
+}
+
+// validateSessionDurations 检查登录时长选项，时长以分钟为最小展示单位
+func validateSessionDurations(conf vars.SessionConfig) error {
+	check := func(name string, durations []int, def int) error {
+		for _, d := range durations {
+			if d < 60 {
+				return fmt.Errorf("%s.durations: %d is less than 60 seconds", name, d)
+			}
+		}
+		if def != 0 && def < 60 {
+			return fmt.Errorf("%s.default_duration: %d is less than 60 seconds", name, def)
+		}
+		return nil
+	}
+	if err := check("session", conf.Durations, conf.DefaultDuration); err != nil {
+		return err
+	}
+	for i, p := range conf.Policies {
+		if err := check(fmt.Sprintf("session.policies[%d]", i), p.Durations, p.DefaultDuration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishConfig 发布读取的配置，调用方需持有 vars.ConfigMu 或处于启动阶段
+// 使用配置文件中的用户时先检查密码指纹，密码在外部修改过（包括服务停止期间）时更换 Nonce，并把 Nonce 和指纹写回配置文件
+// users 被环境变量覆盖时无法写回，不检查指纹
+func publishConfig(conf vars.ConfigFile) {
+	_, envUsers := conf.EnvOverrides["users"]
+	if conf.Database.Path != "" || conf.UserFile.Path != "" || envUsers {
+		vars.SetConfig(conf)
+		return
+	}
+	base := conf
+	conf.Users = slices.Clone(conf.Users)
+	rotated, updated := utils.CheckPasswordFingerprints(utils.ConfigActiveSecrets(&conf), conf.Users)
+	if len(rotated) > 0 {
+		logrus.Infof("Password of %v changed in config, issued tokens are revoked", rotated)
+	}
+	if !updated {
+		vars.SetConfig(conf)
+		return
+	}
+	// 只写回 Nonce 和指纹，其余内容保持文件原样
+	if err := utils.SaveConfigFrom(base, conf); err != nil {
+		logrus.Errorf("Save config failed: %v", err)
+		vars.SetConfig(conf)
+	}
+}
+
+// reloadConfig 重新读取配置文件并替换当前配置
+// 监听地址、TLS、登录限制参数等启动时使用的配置需要重启后才能生效
+func reloadConfig() error {
+	conf, err := readConfig(vars.ConfigPath)
+	if err != nil {
+		return err
+	}
+	logLevel, err := logrus.ParseLevel(conf.LogLevel)
+	if err != nil {
+		return err
+	}
+	vars.ConfigMu.Lock()
+	publishConfig(conf)
+	vars.ConfigMu.Unlock()
+	if vars.AuthCache != nil {
+		vars.AuthCache.Clear()
+	}
+	logrus.SetLevel(logLevel)
+	logrus.Infof("Config reloaded from %s", vars.ConfigPath)
+	return nil
+}
@@ -0,0 +1,108 @@
+package startup
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"github.com/zjyl1994/arkauthn/server"
+)
+
+const defaultShutdownTimeout = 30
+
+// shutdownHooks 退出前需要执行的清理操作，如关闭数据库和日志文件
+var shutdownHooks []func() error
+
+// stateFiles 保存在文件中的内存状态，退出前写入，平滑重启时新进程读取
+var stateFiles []stateFile
+
+type stateFile struct {
+	save func() error
+	load func() error
+}
+
+func onShutdown(fn func() error) {
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+func onSaveState(save, load func() error) {
+	stateFiles = append(stateFiles, stateFile{save: save, load: load})
+}
+
+func saveState() {
+	for _, f := range stateFiles {
+		if err := f.save(); err != nil {
+			logrus.Errorf("Save state failed: %v", err)
+		}
+	}
+}
+
+// reloadState 平滑重启的新进程在旧进程退出后合并其保存的状态
+func reloadState() error {
+	var errs []error
+	for _, f := range stateFiles {
+		errs = append(errs, f.load())
+	}
+	return errors.Join(errs...)
+}
+
+func runShutdownHooks() {
+	saveState()
+	for _, fn := range shutdownHooks {
+		if err := fn(); err != nil {
+			logrus.Errorf("Shutdown hook failed: %v", err)
+		}
+	}
+}
+
+// waitForShutdown 等待服务退出或收到信号
+// SIGINT/SIGTERM 平滑退出；SIGUSR2 先将监听器交给新进程再平滑退出，用于无中断升级
+// SIGHUP 重新加载配置文件
+func waitForShutdown(serverErr <-chan error) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case err := <-serverErr:
+			runShutdownHooks()
+			return err
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					logrus.Errorf("Reload config failed: %v", err)
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				// 先保存状态，新进程启动时即可读取；旧进程处理完剩余请求后再保存一次，由新进程合并
+				saveState()
+				if err := server.Handoff(); err != nil {
+					logrus.Errorf("Handoff to new process failed: %v", err)
+					continue
+				}
+			} else if _, err := utils.SdNotify("STOPPING=1"); err != nil {
+				logrus.Warnf("sd_notify STOPPING failed: %v", err)
+			}
+			logrus.Infof("Received %s, shutting down", sig)
+
+			timeout := vars.Config().ShutdownTimeout
+			if timeout <= 0 {
+				timeout = defaultShutdownTimeout
+			}
+			if err := server.Shutdown(time.Duration(timeout) * time.Second); err != nil {
+				logrus.Errorf("Shutdown server failed: %v", err)
+			}
+			err := <-serverErr
+			runShutdownHooks()
+			server.FinishHandoff()
+			return err
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package startup
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"os"
+	"path/filepath"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -16,9 +17,12 @@ import (
 )
 
 func Start() error {
+	if ok, err := runCommand(); ok {
+		return err
+	}
 	// init config
 	var configFile string
-	flag.StringVar(&configFile, "config", "config.json", "Config JSON path")
+	flag.StringVar(&configFile, "config", "config.json", "Config file path (JSON, YAML or TOML)")
 	flag.Parse()
 	if configFile != "" {
 		if _, err := os.Stat(configFile); os.IsNotExist(err) {
@@ -40,61 +44,156 @@ func Start() error {
 					BanDuration: 300,
 				},
 			}
-			data, err := json.MarshalIndent(defaultConfig, "", "    ")
+			data, err := utils.EncodeConfig(configFile, defaultConfig)
 			if err != nil {
 				return err
 			}
-			if err := os.WriteFile(configFile, data, 0644); err != nil {
+			if err := os.WriteFile(configFile, data, 0600); err != nil {
 				return err
 			}
 			logrus.Infof("Created default config file: %s", configFile)
 		}
 
-		bConf, err := os.ReadFile(configFile)
-		if err != nil {
-			return err
-		}
-		err = json.Unmarshal(bConf, &vars.Config)
+		vars.ConfigPath = configFile
+		conf, err := readConfig(configFile)
 		if err != nil {
 			return err
 		}
-		if vars.Config.Listen == "" {
-			vars.Config.Listen = "127.0.0.1:9008"
-		}
-		if vars.Config.Redirect == "" {
-			vars.Config.Redirect = "http://127.0.0.1:9008"
-		}
-		if vars.Config.LogLevel == "" {
-			vars.Config.LogLevel = "info"
-		}
-		if vars.Config.Jail.Enabled {
-			if vars.Config.Jail.MaxAttempts == 0 {
-				vars.Config.Jail.MaxAttempts = 5
+		publishConfig(conf)
+		if vars.Config().Jail.Enabled {
+			limiter := utils.NewErrorSlidingWindowLimiter(vars.Config().Jail.MaxAttempts, time.Duration(vars.Config().Jail.BanDuration)*time.Second)
+			if stateFile := vars.Config().Jail.StateFile; stateFile != "" {
+				if err := limiter.LoadState(stateFile); err != nil {
+					return err
+				}
+				onSaveState(
+					func() error { return limiter.SaveState(stateFile) },
+					func() error { return limiter.LoadState(stateFile) },
+				)
+				server.RegisterReadinessCheck("jail_state", func() error {
+					return utils.CheckDirWritable(filepath.Dir(stateFile))
+				})
 			}
-			if vars.Config.Jail.BanDuration == 0 {
-				vars.Config.Jail.BanDuration = 300
-			}
-			vars.AuthRateLimiter = utils.NewErrorSlidingWindowLimiter(vars.Config.Jail.MaxAttempts, time.Duration(vars.Config.Jail.BanDuration)*time.Second)
+			vars.AuthRateLimiter = limiter
 		}
 	}
 	// init log
-	logLevel, err := logrus.ParseLevel(vars.Config.LogLevel)
+	logLevel, err := logrus.ParseLevel(vars.Config().LogLevel)
 	if err != nil {
 		return err
 	}
 	logrus.SetLevel(logLevel)
-	if len(vars.Config.LogFile) > 0 {
+	if len(vars.Config().LogFile) > 0 {
 		fileLogger := &lumberjack.Logger{
-			Filename:   vars.Config.LogFile,
+			Filename:   vars.Config().LogFile,
 			MaxSize:    10,
 			MaxBackups: 3,
 			MaxAge:     7,
 			Compress:   true,
 		}
 		logrus.AddHook(utils.NewFileHook(fileLogger))
+		onShutdown(fileLogger.Close)
+	}
+	if err := initStores(); err != nil {
+		return err
+	}
+	if cacheConf := vars.Config().AuthCache; cacheConf.Enabled {
+		cache := utils.NewDecisionCache(cacheConf.Size * 1024 * 1024)
+		vars.SessionStore = cache.WrapSessionStore(vars.SessionStore)
+		vars.UserStore = cache.WrapUserStore(vars.UserStore)
+		vars.AuthCache = cache
+	}
+	if breachedFile := vars.Config().PasswordPolicy.BreachedFile; breachedFile != "" {
+		checker, err := utils.NewPwnedPasswordChecker(breachedFile)
+		if err != nil {
+			return err
+		}
+		vars.PwnedPasswords = checker
+		warnBreachedPlaintextPasswords()
 	}
-	vars.CapInstance = cap.NewCap(utils.NewFreeCacheStorage(50 * 1024))
+	capStorage := utils.NewFreeCacheStorage(50 * 1024)
+	vars.CapInstance = cap.NewCap(capStorage)
+	server.RegisterReadinessCheck("cap_storage", capStorage.HealthCheck)
+	server.SetConfigReloader(reloadConfig)
+	server.SetStateReloader(reloadState)
 	// start server
-	logrus.Infoln("ArkAuthn running in", vars.Config.Listen)
-	return server.Run(vars.Config.Listen)
+	logrus.Infoln("ArkAuthn running in", vars.Config().Listen)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Run(vars.Config().Listen)
+	}()
+	return waitForShutdown(serverErr)
+}
+
+// initStores 初始化用户、会话和审计日志的存储
+func initStores() error {
+	if dbConf := vars.Config().Database; dbConf.Path != "" {
+		if vars.Config().UserFile.Path != "" {
+			return errors.New("database and user_file cannot be used together")
+		}
+		if len(vars.Config().Users) > 0 {
+			logrus.Warnf("database is configured, users in %s are ignored, run migrate to import them", vars.ConfigPath)
+		}
+		store, err := utils.NewSQLiteStore(dbConf)
+		if err != nil {
+			return err
+		}
+		onShutdown(store.Close)
+		if err := store.Users.CheckPasswordFingerprints(); err != nil {
+			return err
+		}
+		server.RegisterReadinessCheck("database", store.HealthCheck)
+		vars.UserStore = store.Users
+		vars.SessionStore = store.Sessions
+		vars.AuditLog = store.Audit
+		vars.APIKeyStore = store.APIKeys
+		vars.MFASecretStore = store.MFASecrets
+		return nil
+	}
+
+	if vars.Config().UserFile.Path != "" {
+		if len(vars.Config().Users) > 0 {
+			logrus.Warnf("user_file is configured, users in %s are ignored", vars.ConfigPath)
+		}
+		userStore, err := utils.NewFileUserStore(vars.Config().UserFile)
+		if err != nil {
+			return err
+		}
+		vars.UserStore = userStore
+	} else {
+		vars.UserStore = utils.NewConfigUserStore()
+	}
+	vars.AuditLog = utils.NewMemoryAuditLog(500)
+	sessionStore := utils.NewMemorySessionStore()
+	if stateFile := vars.Config().SessionState; stateFile != "" {
+		if err := sessionStore.LoadState(stateFile); err != nil {
+			return err
+		}
+		onSaveState(
+			func() error { return sessionStore.SaveState(stateFile) },
+			func() error { return sessionStore.LoadState(stateFile) },
+		)
+		server.RegisterReadinessCheck("session_state", func() error {
+			return utils.CheckDirWritable(filepath.Dir(stateFile))
+		})
+	} else {
+		logrus.Warnln("session_state_file is not configured, revoked sessions and logouts become valid again after restart")
+	}
+	vars.SessionStore = sessionStore
+	return nil
+}
+
+// warnBreachedPlaintextPasswords 检查配置中以明文保存的密码是否已经泄露
+func warnBreachedPlaintextPasswords() {
+	for _, u := range vars.UserStore.List() {
+		if utils.IsPasswordHash(u.Password) {
+			continue
+		}
+		if pwned, err := vars.PwnedPasswords.IsPwned(u.Password); err != nil {
+			logrus.Errorf("Check breached password failed: %v", err)
+			return
+		} else if pwned {
+			logrus.Warnf("User %s is using a breached plaintext password, please change it", u.Username)
+		}
+	}
 }
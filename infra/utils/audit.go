@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"sync"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// MemoryAuditLog 在内存中保留最近的审计事件，超出容量时覆盖最旧的事件
+type MemoryAuditLog struct {
+	mu     sync.Mutex
+	events []vars.AuditEvent
+	next   int
+	full   bool
+}
+
+func NewMemoryAuditLog(capacity int) *MemoryAuditLog {
+	return &MemoryAuditLog{
+		events: make([]vars.AuditEvent, capacity),
+	}
+}
+
+func (a *MemoryAuditLog) Record(event vars.AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events[a.next] = event
+	a.next = (a.next + 1) % len(a.events)
+	if a.next == 0 {
+		a.full = true
+	}
+}
+
+// Recent 按时间倒序返回最近的 n 条事件
+func (a *MemoryAuditLog) Recent(n int) []vars.AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	size := a.next
+	if a.full {
+		size = len(a.events)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	result := make([]vars.AuditEvent, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (a.next - i + len(a.events)) % len(a.events)
+		result = append(result, a.events[idx])
+	}
+	return result
+}
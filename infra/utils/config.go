@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// SaveConfig 将修改后的配置写回配置文件，成功后发布为当前配置，调用方需持有 vars.ConfigMu
+// 只写入相对当前配置修改的字段，见 SaveConfigFrom
+func SaveConfig(conf vars.ConfigFile) error {
+	return SaveConfigFrom(*vars.Config(), conf)
+}
+
+// SaveConfigFrom 将 base 到 conf 的修改写回配置文件，成功后发布 conf
+// 在配置文件原文上修改，保留注释和格式，不写入读取时填充的默认值；修改被环境变量覆盖的字段时返回 ErrConfigEnvOverridden
+// 先写入临时文件再重命名，避免写入中途失败导致配置文件损坏
+func SaveConfigFrom(base, conf vars.ConfigFile) error {
+	if vars.ConfigPath == "" {
+		return errors.New("config path is empty")
+	}
+	data, err := os.ReadFile(vars.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err = PatchConfig(vars.ConfigPath, data, base, conf)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(vars.ConfigPath, data, 0600); err != nil {
+		return err
+	}
+	conf.Hash = hex.EncodeToString(SHA256(data))
+	vars.SetConfig(conf)
+	return nil
+}
+
+// WriteFileAtomic 先写入同目录的临时文件再重命名，文件已存在时保留原有权限
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if st, err := os.Stat(path); err == nil {
+		perm = st.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".arkauthn-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// ConfigEnvPrefix 覆盖配置的环境变量前缀，字段路径转换为大写并用下划线连接，如 ARKAUTHN_JAIL_MAX_ATTEMPTS
+const ConfigEnvPrefix = "ARKAUTHN_"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ConfigFormatByPath 根据扩展名判断配置文件格式，默认为 JSON
+func ConfigFormatByPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	}
+	return ConfigFormatJSON
+}
+
+// DecodeConfig 解析配置文件并应用环境变量覆盖
+// YAML 和 TOML 先转换为与 JSON 相同的结构，字段名统一使用 JSON 字段名
+// 语法错误直接返回 err；未知字段、环境变量和字段类型错误全部放在 problems 中，配置的其余部分仍然可用
+func DecodeConfig(path string, data []byte) (conf vars.ConfigFile, problems []error, err error) {
+	tree, err := decodeConfigTree(ConfigFormatByPath(path), data)
+	if err != nil {
+		return conf, nil, err
+	}
+	confType := reflect.TypeOf(conf)
+	for _, key := range unknownConfigKeys(tree, confType, "") {
+		problems = append(problems, fmt.Errorf("unknown config key %q", key))
+	}
+	overrides := make(map[string]json.RawMessage)
+	problems = append(problems, applyEnvOverrides(tree, confType, nil, overrides)...)
+	merged, err := json.Marshal(tree)
+	if err != nil {
+		return conf, nil, err
+	}
+	if err := json.Unmarshal(merged, &conf); err != nil {
+		problems = append(problems, err)
+	}
+	if len(overrides) > 0 {
+		conf.EnvOverrides = overrides
+	}
+	return conf, problems, nil
+}
+
+// EncodeConfig 按配置文件的格式序列化完整配置，用于新建或内容为空的配置文件，已有内容时由 PatchConfig 只写入修改
+// 从环境变量、文件引用和 ARKAUTHN_* 环境变量覆盖得到的值恢复为配置文件中的原始值
+func EncodeConfig(path string, conf vars.ConfigFile) ([]byte, error) {
+	conf = configForSave(conf)
+	if err := restoreEnvOverrides(&conf); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	switch ConfigFormatByPath(path) {
+	case ConfigFormatYAML:
+		// JSON 是 YAML 的子集，解析为节点后清除引号和流式风格，保持字段顺序
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		pruneYAMLNode(&node)
+		return yaml.Marshal(&node)
+	case ConfigFormatTOML:
+		var tree map[string]any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(pruneTree(tree)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+func decodeConfigTree(format string, data []byte) (map[string]any, error) {
+	tree := make(map[string]any)
+	var err error
+	switch format {
+	case ConfigFormatYAML:
+		err = yaml.Unmarshal(data, &tree)
+	case ConfigFormatTOML:
+		err = toml.Unmarshal(data, &tree)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s config: %w", format, err)
+	}
+	return tree, nil
+}
+
+// configFields 返回结构体的 JSON 字段名和字段，忽略 json:"-" 的字段
+func configFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// unknownConfigKeys 返回配置中结构体没有定义的字段路径
+func unknownConfigKeys(node any, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[string]any)
+		if !ok || t == timeType {
+			return nil
+		}
+		fields := configFields(t)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			f, ok := fields[k]
+			if !ok {
+				unknown = append(unknown, path+k)
+				continue
+			}
+			unknown = append(unknown, unknownConfigKeys(m[k], f.Type, path+k+".")...)
+		}
+	case reflect.Slice:
+		arr, ok := node.([]any)
+		if !ok {
+			return nil
+		}
+		prefix := strings.TrimSuffix(path, ".")
+		for i, v := range arr {
+			unknown = append(unknown, unknownConfigKeys(v, t.Elem(), fmt.Sprintf("%s[%d].", prefix, i))...)
+		}
+	}
+	return unknown
+}
+
+// applyEnvOverrides 用 ARKAUTHN_* 环境变量覆盖配置，结构体字段逐级展开
+// 列表可以用逗号分隔或 JSON 数组，对象列表等复杂类型使用 JSON
+func applyEnvOverrides(tree map[string]any, t reflect.Type, path []string, overrides map[string]json.RawMessage) []error {
+	var problems []error
+	for name, f := range configFields(t) {
+		fieldPath := append(slices.Clone(path), name)
+		ft := f.Type
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			child, ok := tree[name].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+			}
+			problems = append(problems, applyEnvOverrides(child, ft, fieldPath, overrides)...)
+			if len(child) > 0 {
+				tree[name] = child
+			}
+			continue
+		}
+		envName := ConfigEnvPrefix + strings.ToUpper(strings.Join(fieldPath, "_"))
+		raw, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		value, err := parseEnvValue(raw, ft)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", envName, err))
+			continue
+		}
+		var original json.RawMessage
+		if old, exists := tree[name]; exists {
+			original, _ = json.Marshal(old)
+		}
+		overrides[strings.Join(fieldPath, ".")] = original
+		tree[name] = value
+	}
+	return problems
+}
+
+func parseEnvValue(raw string, t reflect.Type) (any, error) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(raw, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(raw, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(raw, 64)
+	case reflect.Slice:
+		if elem := t.Elem().Kind(); !strings.HasPrefix(strings.TrimSpace(raw), "[") && (elem == reflect.String || elem == reflect.Int) {
+			var items []any
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				v, err := parseEnvValue(item, t.Elem())
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			}
+			return items, nil
+		}
+	case reflect.Struct:
+		if t == timeType {
+			return raw, nil
+		}
+	}
+	var v any
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, fmt.Errorf("invalid JSON value: %w", err)
+	}
+	return v, nil
+}
+
+// restoreEnvOverrides 将被环境变量覆盖的字段恢复为配置文件中的原始值，配置文件中没有的字段恢复为空
+func restoreEnvOverrides(conf *vars.ConfigFile) error {
+	for path, original := range conf.EnvOverrides {
+		v := reflect.ValueOf(conf).Elem()
+		for _, name := range strings.Split(path, ".") {
+			f, ok := configFields(v.Type())[name]
+			if !ok {
+				return fmt.Errorf("unknown config path %s", path)
+			}
+			v = v.FieldByIndex(f.Index)
+		}
+		v.SetZero()
+		if original != nil {
+			if err := json.Unmarshal(original, v.Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneYAMLNode 清除引号和流式风格，删除空对象
+func pruneYAMLNode(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		pruneYAMLNode(child)
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	content := node.Content[:0]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if v := node.Content[i+1]; v.Kind == yaml.MappingNode && len(v.Content) == 0 {
+			continue
+		}
+		content = append(content, node.Content[i], node.Content[i+1])
+	}
+	node.Content = content
+}
+
+// pruneTree 删除值为 null 的字段和空对象，TOML 不支持 null
+func pruneTree(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, item := range x {
+			item = pruneTree(item)
+			if m, ok := item.(map[string]any); item == nil || (ok && len(m) == 0) {
+				delete(x, k)
+			} else {
+				x[k] = item
+			}
+		}
+	case []any:
+		for i, item := range x {
+			x[i] = pruneTree(item)
+		}
+	}
+	return v
+}
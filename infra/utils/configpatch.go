@@ -0,0 +1,905 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrConfigEnvOverridden 修改的字段被 ARKAUTHN_* 环境变量覆盖，写入配置文件不会生效
+var ErrConfigEnvOverridden = errors.New("config field is overridden by environment variable")
+
+// configPath 配置字段路径，元素为字段名（string）或列表下标（int）
+type configPath []any
+
+func (p configPath) child(elem any) configPath {
+	return append(slices.Clone(p), elem)
+}
+
+// String 返回 users[1].password 形式的路径，与 SecretRefs、EnvOverrides 的键相同
+func (p configPath) String() string {
+	var sb strings.Builder
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%d]", e)
+		case string:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(e)
+		}
+	}
+	return sb.String()
+}
+
+// hasPrefix 判断 prefix 是否为 p 的前缀
+func (p configPath) hasPrefix(prefix configPath) bool {
+	return len(prefix) <= len(p) && slices.Equal(p[:len(prefix)], prefix)
+}
+
+// configChange 相对读取时的配置修改的字段，delete 为 false 时写入新配置中该路径的值
+type configChange struct {
+	path   configPath
+	delete bool
+}
+
+// PatchConfig 将 base 到 conf 的修改写入配置文件的原始内容 data，只修改变化的字段
+// 注释、字段顺序和未修改的部分保持不变，读取配置时填充的默认值在 base 和 conf 中相同，不会写入文件
+// 修改了被环境变量覆盖的字段时返回 ErrConfigEnvOverridden；data 为空时按 EncodeConfig 写入完整配置
+func PatchConfig(path string, data []byte, base, conf vars.ConfigFile) ([]byte, error) {
+	oldNode, err := configNode(base)
+	if err != nil {
+		return nil, err
+	}
+	newNode, err := configNode(conf)
+	if err != nil {
+		return nil, err
+	}
+	var changes []configChange
+	diffConfigNodes(nil, oldNode, newNode, &changes)
+	if err := checkEnvOverrides(changes, conf.EnvOverrides); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return EncodeConfig(path, conf)
+	}
+	if len(changes) == 0 {
+		return data, nil
+	}
+	switch ConfigFormatByPath(path) {
+	case ConfigFormatTOML:
+		return patchTOML(data, newNode, changes)
+	case ConfigFormatYAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+		}
+		for _, c := range changes {
+			patchYAMLNode(doc.Content[0], newNode, c)
+		}
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(yamlIndent(data))
+		if err := enc.Encode(&doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	root, err := decodeJSONNode(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		patchYAMLNode(root, newNode, c)
+	}
+	var buf bytes.Buffer
+	if err := encodeJSONNode(&buf, root, jsonIndent(data), ""); err != nil {
+		return nil, err
+	}
+	if bytes.HasSuffix(data, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// configNode 将配置转换为节点树，字段顺序与结构体定义相同，引用的密钥恢复为原始引用，删除值为 null 的字段
+func configNode(conf vars.ConfigFile) (*yaml.Node, error) {
+	data, err := json.Marshal(configForSave(conf))
+	if err != nil {
+		return nil, err
+	}
+	root, err := decodeJSONNode(data)
+	if err != nil {
+		return nil, err
+	}
+	dropNullFields(root)
+	return root, nil
+}
+
+func dropNullFields(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if v := n.Content[i+1]; v.Kind != yaml.ScalarNode || v.Tag != "!!null" {
+				content = append(content, n.Content[i], v)
+			}
+		}
+		n.Content = content
+	}
+	for _, child := range n.Content {
+		dropNullFields(child)
+	}
+}
+
+// diffConfigNodes 比较两棵节点树，对象逐个字段、列表逐个元素比较，找出需要写入或删除的最小路径
+func diffConfigNodes(path configPath, old, cur *yaml.Node, changes *[]configChange) {
+	switch {
+	case old.Kind == yaml.MappingNode && cur.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(cur.Content); i += 2 {
+			key := cur.Content[i].Value
+			if o := mappingValue(old, key); o != nil {
+				diffConfigNodes(path.child(key), o, cur.Content[i+1], changes)
+			} else {
+				*changes = append(*changes, configChange{path: path.child(key)})
+			}
+		}
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			if key := old.Content[i].Value; mappingValue(cur, key) == nil {
+				*changes = append(*changes, configChange{path: path.child(key), delete: true})
+			}
+		}
+	case old.Kind == yaml.SequenceNode && cur.Kind == yaml.SequenceNode:
+		n := min(len(old.Content), len(cur.Content))
+		for i := 0; i < n; i++ {
+			diffConfigNodes(path.child(i), old.Content[i], cur.Content[i], changes)
+		}
+		for i := n; i < len(cur.Content); i++ {
+			*changes = append(*changes, configChange{path: path.child(i)})
+		}
+		// 从后往前删除，前面元素的下标不变
+		for i := len(old.Content) - 1; i >= n; i-- {
+			*changes = append(*changes, configChange{path: path.child(i), delete: true})
+		}
+	default:
+		if !nodeEqual(old, cur) {
+			*changes = append(*changes, configChange{path: path})
+		}
+	}
+}
+
+func nodeEqual(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind || len(a.Content) != len(b.Content) {
+		return false
+	}
+	if a.Kind == yaml.ScalarNode && (a.Value != b.Value || a.ShortTag() != b.ShortTag()) {
+		return false
+	}
+	for i := range a.Content {
+		if !nodeEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkEnvOverrides 被环境变量覆盖的字段在配置中是环境变量的值，修改后无法写回配置文件，拒绝修改而不是丢弃修改
+func checkEnvOverrides(changes []configChange, overrides map[string]json.RawMessage) error {
+	for _, c := range changes {
+		name := c.path.String()
+		for key := range overrides {
+			if name == key || strings.HasPrefix(name, key+".") || strings.HasPrefix(name, key+"[") || strings.HasPrefix(key, name+".") {
+				envName := ConfigEnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+				return fmt.Errorf("%w: %s is set by %s", ErrConfigEnvOverridden, key, envName)
+			}
+		}
+	}
+	return nil
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// lookupNode 返回节点树中路径对应的节点，不存在时返回 nil
+func lookupNode(n *yaml.Node, path configPath) *yaml.Node {
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case string:
+			n = mappingValue(n, e)
+		case int:
+			if n.Kind != yaml.SequenceNode || e >= len(n.Content) {
+				return nil
+			}
+			n = n.Content[e]
+		}
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// patchYAMLNode 在配置文件的节点树中应用一项修改，写入的值取自新配置的节点树 newRoot
+// 配置文件在读取后被修改过、结构与读取时不一致时，整体替换能找到的最深一级
+func patchYAMLNode(root, newRoot *yaml.Node, c configChange) {
+	cur := root
+	for i, elem := range c.path {
+		child := yamlChild(cur, elem)
+		if child != nil && i < len(c.path)-1 {
+			cur = child
+			continue
+		}
+		if c.delete {
+			if child != nil {
+				removeYAMLChild(cur, elem)
+			}
+			return
+		}
+		if !setYAMLChild(cur, elem, newYAMLValue(lookupNode(newRoot, c.path[:i+1]))) {
+			replaceYAMLValue(cur, newYAMLValue(lookupNode(newRoot, c.path[:i])))
+		}
+		return
+	}
+}
+
+func yamlChild(n *yaml.Node, elem any) *yaml.Node {
+	switch e := elem.(type) {
+	case string:
+		return mappingValue(n, e)
+	case int:
+		if n.Kind == yaml.SequenceNode && e < len(n.Content) {
+			return n.Content[e]
+		}
+	}
+	return nil
+}
+
+func setYAMLChild(n *yaml.Node, elem any, value *yaml.Node) bool {
+	if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null" {
+		// null 或空值按空对象、空列表处理
+		n.Kind, n.Tag, n.Value, n.Style = yaml.MappingNode, "", "", 0
+		if _, ok := elem.(int); ok {
+			n.Kind = yaml.SequenceNode
+		}
+	}
+	switch e := elem.(type) {
+	case string:
+		if n.Kind != yaml.MappingNode {
+			return false
+		}
+		if old := mappingValue(n, e); old != nil {
+			replaceYAMLValue(old, value)
+			return true
+		}
+		n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: e}, value)
+		return true
+	case int:
+		if n.Kind != yaml.SequenceNode || e > len(n.Content) {
+			return false
+		}
+		if e == len(n.Content) {
+			n.Content = append(n.Content, value)
+		} else {
+			replaceYAMLValue(n.Content[e], value)
+		}
+		return true
+	}
+	return false
+}
+
+func removeYAMLChild(n *yaml.Node, elem any) {
+	switch e := elem.(type) {
+	case string:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == e {
+				n.Content = slices.Delete(n.Content, i, i+2)
+				return
+			}
+		}
+	case int:
+		n.Content = slices.Delete(n.Content, e, e+1)
+	}
+}
+
+// replaceYAMLValue 替换节点的值，保留原节点上的注释
+func replaceYAMLValue(n, value *yaml.Node) {
+	head, line, foot := n.HeadComment, n.LineComment, n.FootComment
+	*n = *value
+	n.HeadComment, n.LineComment, n.FootComment = head, line, foot
+}
+
+// newYAMLValue 复制新配置中的节点，清除引号和流式风格，删除空对象
+func newYAMLValue(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = make([]*yaml.Node, len(n.Content))
+	for i, child := range n.Content {
+		c.Content[i] = newYAMLValue(child)
+	}
+	pruneYAMLNode(&c)
+	return &c
+}
+
+// yamlIndent 返回配置文件使用的缩进宽度，取最小的非零缩进
+func yamlIndent(data []byte) int {
+	indent := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if n := len(line) - len(trimmed); n > 0 && trimmed != "" && !strings.HasPrefix(trimmed, "#") && (indent == 0 || n < indent) {
+			indent = n
+		}
+	}
+	if indent < 2 || indent > 8 {
+		return 4
+	}
+	return indent
+}
+
+// decodeJSONNode 按原有顺序将 JSON 解析为节点树
+func decodeJSONNode(data []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	n, err := readJSONNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return n, nil
+}
+
+func readJSONNode(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		if t == '{' {
+			n.Kind = yaml.MappingNode
+		}
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			child, err := readJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, child)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: t}, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(t.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: t.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(t)}, nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
+
+// encodeJSONNode 按节点顺序输出 JSON
+func encodeJSONNode(buf *bytes.Buffer, n *yaml.Node, indent, prefix string) error {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close := "[", "]"
+		step := 1
+		if n.Kind == yaml.MappingNode {
+			open, close, step = "{", "}", 2
+		}
+		if len(n.Content) == 0 {
+			buf.WriteString(open + close)
+			return nil
+		}
+		buf.WriteString(open)
+		for i := 0; i < len(n.Content); i += step {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString("\n" + prefix + indent)
+			if step == 2 {
+				buf.WriteString(jsonString(n.Content[i].Value) + ": ")
+			}
+			if err := encodeJSONNode(buf, n.Content[i+step-1], indent, prefix+indent); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("\n" + prefix + close)
+		return nil
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!str":
+			buf.WriteString(jsonString(n.Value))
+		case "!!int", "!!float", "!!bool":
+			buf.WriteString(n.Value)
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			return fmt.Errorf("unsupported JSON value %q", n.Value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JSON node kind %d", n.Kind)
+}
+
+// jsonString 输出 JSON 字符串，不转义 HTML 字符；转义规则同样适用于 TOML 的基本字符串
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// jsonIndent 返回配置文件第一个缩进行使用的缩进
+func jsonIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "    "
+}
+
+// tomlDoc 按行解析的 TOML 文档，只识别表头和键值对的位置，用于在原文上修改
+type tomlDoc struct {
+	lines    []string
+	sections []*tomlSection
+}
+
+type tomlSection struct {
+	header  int        // 表头所在行，根表为 -1
+	end     int        // 下一个表头所在行
+	path    configPath // 表的完整路径，数组表包含元素下标
+	array   bool
+	entries []tomlEntry
+}
+
+type tomlEntry struct {
+	key        []string
+	start, end int    // 占用的行 [start, end)
+	keyText    string // 等号之前的原文
+	comment    string // 值之后的注释，包括前面的空白
+}
+
+func (s *tomlSection) entryPath(e tomlEntry) configPath {
+	p := slices.Clone(s.path)
+	for _, k := range e.key {
+		p = append(p, k)
+	}
+	return p
+}
+
+// patchTOML 逐项修改 TOML 原文，每项修改后重新解析
+func patchTOML(data []byte, newRoot *yaml.Node, changes []configChange) ([]byte, error) {
+	text := string(data)
+	for _, c := range changes {
+		doc, err := parseTOMLDoc(text)
+		if err != nil {
+			return nil, err
+		}
+		if c.delete {
+			doc.remove(c.path, newRoot)
+		} else {
+			doc.set(c.path, newRoot)
+		}
+		text = strings.Join(doc.lines, "\n")
+	}
+	return []byte(text), nil
+}
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func parseTOMLDoc(text string) (*tomlDoc, error) {
+	doc := &tomlDoc{lines: strings.Split(text, "\n")}
+	section := &tomlSection{header: -1}
+	doc.sections = append(doc.sections, section)
+	arrays := make(map[string]int) // 数组表的路径 -> 已出现的元素个数
+	resolve := func(name []string) configPath {
+		var p configPath
+		for i, part := range name {
+			p = append(p, part)
+			if n, ok := arrays[p.String()]; ok && i < len(name)-1 {
+				p = append(p, n-1)
+			}
+		}
+		return p
+	}
+	for i := 0; i < len(doc.lines); i++ {
+		line := doc.lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			array := strings.HasPrefix(trimmed, "[[")
+			start := 1
+			if array {
+				start = 2
+			}
+			name, _, err := parseTOMLKey(trimmed, start)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			path := resolve(name)
+			if array {
+				arrays[path.String()]++
+				path = append(path, arrays[path.String()]-1)
+			}
+			section.end = i
+			section = &tomlSection{header: i, path: path, array: array}
+			doc.sections = append(doc.sections, section)
+			continue
+		}
+		key, eq, err := parseTOMLKey(line, 0)
+		if err != nil || eq >= len(line) || line[eq] != '=' {
+			return nil, fmt.Errorf("line %d: invalid key/value pair", i+1)
+		}
+		end, comment := scanTOMLValue(doc.lines, i, eq+1)
+		section.entries = append(section.entries, tomlEntry{
+			key: key, start: i, end: end,
+			keyText: strings.TrimRight(line[:eq], " \t"), comment: comment,
+		})
+		i = end - 1
+	}
+	section.end = len(doc.lines)
+	if doc.lines[len(doc.lines)-1] == "" {
+		section.end--
+	}
+	return doc, nil
+}
+
+// parseTOMLKey 从 pos 开始解析点分隔的键，返回键的各部分和键之后第一个非空白字符的位置
+func parseTOMLKey(s string, pos int) ([]string, int, error) {
+	var parts []string
+	for {
+		for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t') {
+			pos++
+		}
+		if pos >= len(s) {
+			return nil, pos, errors.New("unexpected end of key")
+		}
+		switch s[pos] {
+		case '"':
+			end := pos + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, pos, errors.New("unterminated quoted key")
+			}
+			part, err := strconv.Unquote(s[pos : end+1])
+			if err != nil {
+				return nil, pos, err
+			}
+			parts = append(parts, part)
+			pos = end + 1
+		case '\'':
+			end := strings.IndexByte(s[pos+1:], '\'')
+			if end < 0 {
+				return nil, pos, errors.New("unterminated quoted key")
+			}
+			parts = append(parts, s[pos+1:pos+1+end])
+			pos += end + 2
+		default:
+			end := pos
+			for end < len(s) && (s[end] == '_' || s[end] == '-' || s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+				end++
+			}
+			if end == pos {
+				return nil, pos, fmt.Errorf("invalid key character %q", s[pos])
+			}
+			parts = append(parts, s[pos:end])
+			pos = end
+		}
+		for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t') {
+			pos++
+		}
+		if pos >= len(s) || s[pos] != '.' {
+			return parts, pos, nil
+		}
+		pos++
+	}
+}
+
+// scanTOMLValue 从 lines[line][col] 开始跳过一个值，值可以是跨行的数组和多行字符串
+// 返回值之后的下一行，以及值所在最后一行的注释
+func scanTOMLValue(lines []string, line, col int) (int, string) {
+	depth := 0
+	quote := "" // 当前所在字符串的引号
+	for ; line < len(lines); line, col = line+1, 0 {
+		s := lines[line]
+		for col < len(s) {
+			if quote != "" {
+				switch {
+				case quote[0] == '"' && s[col] == '\\':
+					col += 2
+				case strings.HasPrefix(s[col:], quote):
+					col += len(quote)
+					quote = ""
+				default:
+					col++
+				}
+				continue
+			}
+			switch ch := s[col]; {
+			case strings.HasPrefix(s[col:], `"""`), strings.HasPrefix(s[col:], `'''`):
+				quote = s[col : col+3]
+				col += 3
+				continue
+			case ch == '"' || ch == '\'':
+				quote = string(ch)
+			case ch == '[' || ch == '{':
+				depth++
+			case ch == ']' || ch == '}':
+				depth--
+			case ch == '#':
+				if depth == 0 {
+					start := col
+					for start > 0 && (s[start-1] == ' ' || s[start-1] == '\t') {
+						start--
+					}
+					return line + 1, s[start:]
+				}
+				col = len(s)
+				continue
+			}
+			col++
+		}
+		if len(quote) == 1 {
+			// 单行字符串不能跨行
+			quote = ""
+		}
+		if depth <= 0 && quote == "" {
+			return line + 1, ""
+		}
+	}
+	return len(lines), ""
+}
+
+// set 写入新配置中 path 的值：已有的键直接替换值，所在位置为内联的数组或表时替换整个内联值
+// 找不到位置时添加到所在的表中，对象添加为新的表，数组表的新元素添加到最后一个元素之后
+func (d *tomlDoc) set(path configPath, newRoot *yaml.Node) {
+	value := lookupNode(newRoot, path)
+	sec, entry, ok := d.locate(path)
+	if ok {
+		p := sec.entryPath(entry)
+		d.replaceEntry(entry, lookupNode(newRoot, p))
+		return
+	}
+	// 文件中有比 path 更深的键或表，先删除再整体写入
+	d.remove(path, newRoot)
+	if doc, err := parseTOMLDoc(strings.Join(d.lines, "\n")); err == nil {
+		*d = *doc
+	}
+	sec, _, _ = d.locate(path)
+	rel := path[len(sec.path):]
+	if idx, ok := path[len(path)-1].(int); ok && value.Kind == yaml.MappingNode {
+		parent := path[:len(path)-1]
+		if last := d.lastArrayElement(parent, idx); last != nil {
+			name := tomlHeaderName(parent)
+			lines := append([]string{"", "[[" + name + "]]"}, tomlTableLines(value, nil)...)
+			d.insert(d.sectionEnd(last), lines)
+			return
+		}
+	}
+	for i, elem := range rel {
+		if _, ok := elem.(int); ok {
+			// 内联数组中的元素，改为写入整个数组
+			d.set(path[:len(sec.path)+i], newRoot)
+			return
+		}
+	}
+	if value.Kind == yaml.MappingNode && !slices.ContainsFunc(path, func(e any) bool { _, ok := e.(int); return ok }) {
+		lines := append([]string{"", "[" + tomlHeaderName(path) + "]"}, tomlTableLines(value, path)...)
+		d.insert(len(d.lines)-boolInt(d.lines[len(d.lines)-1] == ""), lines)
+		return
+	}
+	keys := make([]string, len(rel))
+	for i, elem := range rel {
+		keys[i] = tomlKey(elem.(string))
+	}
+	indent := ""
+	at := sec.header + 1
+	if n := len(sec.entries); n > 0 {
+		last := sec.entries[n-1]
+		at = last.end
+		indent = last.keyText[:len(last.keyText)-len(strings.TrimLeft(last.keyText, " \t"))]
+	} else if sec.header < 0 {
+		at = sec.end
+	}
+	d.insert(at, []string{indent + strings.Join(keys, ".") + " = " + tomlInline(value)})
+}
+
+// remove 删除 path 及其下的所有键和表，path 在内联的数组或表中时改为写入新配置中整个内联值
+func (d *tomlDoc) remove(path configPath, newRoot *yaml.Node) {
+	if sec, entry, ok := d.locate(path); ok {
+		if p := sec.entryPath(entry); len(p) < len(path) {
+			if value := lookupNode(newRoot, p); value != nil {
+				d.replaceEntry(entry, value)
+				return
+			}
+		}
+	}
+	var drop []int
+	for _, sec := range d.sections {
+		if sec.header >= 0 && sec.path.hasPrefix(path) {
+			for i := sec.header; i < sec.end; i++ {
+				drop = append(drop, i)
+			}
+			continue
+		}
+		for _, e := range sec.entries {
+			if sec.entryPath(e).hasPrefix(path) {
+				for i := e.start; i < e.end; i++ {
+					drop = append(drop, i)
+				}
+			}
+		}
+	}
+	for i := len(drop) - 1; i >= 0; i-- {
+		d.lines = slices.Delete(d.lines, drop[i], drop[i]+1)
+	}
+}
+
+// locate 查找覆盖 path 的键：键的完整路径等于 path，或是 path 的前缀（path 在内联值中）
+func (d *tomlDoc) locate(path configPath) (*tomlSection, tomlEntry, bool) {
+	var best *tomlSection
+	for _, sec := range d.sections {
+		if path.hasPrefix(sec.path) && (best == nil || len(sec.path) > len(best.path)) {
+			best = sec
+		}
+	}
+	for _, e := range best.entries {
+		if path.hasPrefix(best.entryPath(e)) {
+			return best, e, true
+		}
+	}
+	return best, tomlEntry{}, false
+}
+
+// lastArrayElement 返回数组表 parent 的最后一个元素，新元素的下标 idx 需要紧跟在已有元素之后
+func (d *tomlDoc) lastArrayElement(parent configPath, idx int) *tomlSection {
+	var last *tomlSection
+	for _, sec := range d.sections {
+		if sec.array && len(sec.path) == len(parent)+1 && sec.path.hasPrefix(parent) {
+			last = sec
+		}
+	}
+	if last == nil || last.path[len(parent)] != idx-1 {
+		return nil
+	}
+	return last
+}
+
+// sectionEnd 返回表及其子表结束的行
+func (d *tomlDoc) sectionEnd(sec *tomlSection) int {
+	end := sec.end
+	for _, s := range d.sections {
+		if s.header > sec.header && s.path.hasPrefix(sec.path) {
+			end = s.end
+		}
+	}
+	return end
+}
+
+func (d *tomlDoc) replaceEntry(e tomlEntry, value *yaml.Node) {
+	line := e.keyText + " = " + tomlInline(value) + e.comment
+	d.lines = slices.Replace(d.lines, e.start, e.end, line)
+}
+
+func (d *tomlDoc) insert(at int, lines []string) {
+	if at > 0 && at <= len(d.lines) && len(lines) > 0 && lines[0] == "" && strings.TrimSpace(d.lines[at-1]) == "" {
+		lines = lines[1:]
+	}
+	d.lines = slices.Insert(d.lines, at, lines...)
+}
+
+// tomlTableLines 输出表的内容，path 不为空时嵌套的对象输出为子表，否则输出为内联表
+func tomlTableLines(n *yaml.Node, path configPath) []string {
+	var lines, subs []string
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i].Value, n.Content[i+1]
+		if value.Kind == yaml.MappingNode && len(value.Content) == 0 {
+			continue
+		}
+		if value.Kind == yaml.MappingNode && path != nil {
+			p := path.child(key)
+			subs = append(subs, "", "["+tomlHeaderName(p)+"]")
+			subs = append(subs, tomlTableLines(value, p)...)
+			continue
+		}
+		lines = append(lines, tomlKey(key)+" = "+tomlInline(value))
+	}
+	return append(lines, subs...)
+}
+
+func tomlHeaderName(path configPath) string {
+	var keys []string
+	for _, elem := range path {
+		if key, ok := elem.(string); ok {
+			keys = append(keys, tomlKey(key))
+		}
+	}
+	return strings.Join(keys, ".")
+}
+
+func tomlKey(key string) string {
+	if tomlBareKey.MatchString(key) {
+		return key
+	}
+	return jsonString(key)
+}
+
+// tomlInline 将节点输出为 TOML 的内联值
+func tomlInline(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		items := make([]string, len(n.Content))
+		for i, child := range n.Content {
+			items[i] = tomlInline(child)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case yaml.MappingNode:
+		var items []string
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			items = append(items, tomlKey(n.Content[i].Value)+" = "+tomlInline(n.Content[i+1]))
+		}
+		if len(items) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	}
+	switch n.ShortTag() {
+	case "!!int", "!!float", "!!bool":
+		return n.Value
+	}
+	return jsonString(n.Value)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+var patchTestConfigs = map[string]string{
+	"config.yaml": `# ArkAuthn 配置
+secret: test-secret # 签名密钥
+users:
+  - username: alice
+    password: "{PLAIN}alice"
+  # 管理员
+  - username: bob
+    password: "{PLAIN}bob"
+    admin: true
+trusted_domains: [example.com]
+`,
+	"config.toml": `# ArkAuthn 配置
+secret = "test-secret" # 签名密钥
+trusted_domains = ["example.com"]
+
+[[users]]
+username = "alice"
+password = "{PLAIN}alice"
+
+# 管理员
+[[users]]
+username = "bob"
+password = "{PLAIN}bob"
+admin = true
+`,
+	"config.json": `{
+  "secret": "test-secret",
+  "users": [
+    {"username": "alice", "password": "{PLAIN}alice"},
+    {"username": "bob", "password": "{PLAIN}bob", "admin": true}
+  ],
+  "trusted_domains": ["example.com"]
+}
+`,
+}
+
+// decodePatchTestConfig 按 readConfig 的方式读取配置并填充默认值
+func decodePatchTestConfig(t *testing.T, path, data string) vars.ConfigFile {
+	t.Helper()
+	conf, problems, err := DecodeConfig(path, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if conf.Listen == "" {
+		conf.Listen = ":8080"
+	}
+	if conf.LogLevel == "" {
+		conf.LogLevel = "info"
+	}
+	return conf
+}
+
+func TestPatchConfig(t *testing.T) {
+	for path, data := range patchTestConfigs {
+		t.Run(path, func(t *testing.T) {
+			base := decodePatchTestConfig(t, path, data)
+			conf := base
+			conf.Users = []vars.UserItem{
+				{Username: "bob", Password: "{PLAIN}bob2", Admin: true},
+				{Username: "carol", Password: "{PLAIN}carol", Groups: []string{"ops"}},
+			}
+			conf.TrustedDomains = []string{"example.com", "example.org"}
+
+			out, err := PatchConfig(path, []byte(data), base, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text := string(out)
+			if path != "config.json" {
+				for _, comment := range []string{"# ArkAuthn 配置", "# 签名密钥"} {
+					if !strings.Contains(text, comment) {
+						t.Errorf("comment %q lost:\n%s", comment, text)
+					}
+				}
+			}
+			for _, field := range []string{"listen", "log_level", "alice"} {
+				if strings.Contains(text, field) {
+					t.Errorf("patched config contains %q:\n%s", field, text)
+				}
+			}
+
+			got := decodePatchTestConfig(t, path, text)
+			if got.Secret != "test-secret" {
+				t.Errorf("secret = %q", got.Secret)
+			}
+			if !slices.Equal(got.TrustedDomains, conf.TrustedDomains) {
+				t.Errorf("trusted_domains = %v, want %v", got.TrustedDomains, conf.TrustedDomains)
+			}
+			if len(got.Users) != 2 {
+				t.Fatalf("users = %+v", got.Users)
+			}
+			for i, want := range conf.Users {
+				u := got.Users[i]
+				if u.Username != want.Username || u.Password != want.Password || u.Admin != want.Admin || !slices.Equal(u.Groups, want.Groups) {
+					t.Errorf("users[%d] = %+v, want %+v", i, u, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchConfigUnchanged(t *testing.T) {
+	for path, data := range patchTestConfigs {
+		t.Run(path, func(t *testing.T) {
+			base := decodePatchTestConfig(t, path, data)
+			out, err := PatchConfig(path, []byte(data), base, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != data {
+				t.Errorf("unchanged config rewritten:\n%s", out)
+			}
+		})
+	}
+}
+
+// 被环境变量覆盖的字段写入文件不会生效，拒绝修改；其他字段仍可修改，文件中保留原始值
+func TestPatchConfigEnvOverridden(t *testing.T) {
+	t.Setenv("ARKAUTHN_TRUSTED_DOMAINS", `["env.example.com"]`)
+	for path, data := range patchTestConfigs {
+		t.Run(path, func(t *testing.T) {
+			base := decodePatchTestConfig(t, path, data)
+			if _, ok := base.EnvOverrides["trusted_domains"]; !ok {
+				t.Fatalf("EnvOverrides = %v", base.EnvOverrides)
+			}
+
+			conf := base
+			conf.TrustedDomains = []string{"admin.example.com"}
+			if _, err := PatchConfig(path, []byte(data), base, conf); !errors.Is(err, ErrConfigEnvOverridden) {
+				t.Errorf("PatchConfig() error = %v, want ErrConfigEnvOverridden", err)
+			}
+
+			conf = base
+			conf.Users = conf.Users[:1]
+			out, err := PatchConfig(path, []byte(data), base, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text := string(out); strings.Contains(text, "env.example.com") || !strings.Contains(text, "example.com") {
+				t.Errorf("trusted_domains not kept:\n%s", out)
+			}
+		})
+	}
+}
+
+// 新建的配置文件写入完整配置
+func TestPatchConfigEmptyFile(t *testing.T) {
+	conf := vars.ConfigFile{Secret: "test-secret", Users: []vars.UserItem{{Username: "alice", Password: "{PLAIN}alice"}}}
+	out, err := PatchConfig("config.yaml", nil, vars.ConfigFile{}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := DecodeConfig("config.yaml", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Secret != conf.Secret || len(got.Users) != 1 || got.Users[0].Username != "alice" {
+		t.Errorf("DecodeConfig() = %+v", got)
+	}
+}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// crypt(3) 兼容的密码哈希，只用于校验从 htpasswd、Dovecot、/etc/shadow 导入的旧密码
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+)
+
+var errInvalidCryptHash = errors.New("invalid crypt hash")
+
+// SHA-256/SHA-512 crypt 输出编码时的字节顺序
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	md5CryptOrder = [][3]int{
+		{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5},
+	}
+)
+
+// verifyCrypt 校验 $1$、$apr1$、$5$、$6$ 格式的密码哈希
+func verifyCrypt(hashed, password string) (bool, error) {
+	var computed string
+	var err error
+	switch {
+	case strings.HasPrefix(hashed, "$6$"):
+		computed, err = shaCrypt(sha512.New, "$6$", sha512CryptOrder, hashed, password)
+	case strings.HasPrefix(hashed, "$5$"):
+		computed, err = shaCrypt(sha256.New, "$5$", sha256CryptOrder, hashed, password)
+	case strings.HasPrefix(hashed, "$1$"):
+		computed, err = md5Crypt("$1$", hashed, password)
+	case strings.HasPrefix(hashed, "$apr1$"):
+		computed, err = md5Crypt("$apr1$", hashed, password)
+	default:
+		return false, errInvalidCryptHash
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+}
+
+// shaCrypt 按 Ulrich Drepper 的 SHA-crypt 规范计算哈希，salt 和轮数从 setting 中读取
+func shaCrypt(newHash func() hash.Hash, magic string, order [][3]int, setting, password string) (string, error) {
+	rest := strings.TrimPrefix(setting, magic)
+	rounds := shaCryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.IndexByte(rest, '$')
+		if end < 0 {
+			return "", errInvalidCryptHash
+		}
+		n, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return "", errInvalidCryptHash
+		}
+		rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		customRounds = true
+		rest = rest[end+1:]
+	}
+	salt := rest
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	altSum := h.Sum(nil)
+	size := len(altSum)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeatBytes(altSum, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(altSum)
+		} else {
+			h.Write(p)
+		}
+	}
+	sum := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	pBytes := repeatBytes(h.Sum(nil), len(p))
+
+	h.Reset()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		h.Write(s)
+	}
+	sBytes := repeatBytes(h.Sum(nil), len(s))
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pBytes)
+		}
+		sum = h.Sum(sum[:0])
+	}
+
+	var b strings.Builder
+	b.WriteString(magic)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt)
+	b.WriteByte('$')
+	for _, o := range order {
+		cryptEncode24(&b, sum[o[0]], sum[o[1]], sum[o[2]], 4)
+	}
+	if size == sha512.Size {
+		cryptEncode24(&b, 0, 0, sum[63], 2)
+	} else {
+		cryptEncode24(&b, 0, sum[31], sum[30], 3)
+	}
+	return b.String(), nil
+}
+
+// md5Crypt 计算 FreeBSD MD5-crypt($1$) 或 Apache htpasswd($apr1$) 哈希
+func md5Crypt(magic, setting, password string) (string, error) {
+	salt := strings.TrimPrefix(setting, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(p)
+	h.Write([]byte(magic))
+	h.Write(s)
+	h.Write(repeatBytes(altSum, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(p[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(p)
+		}
+		sum = h.Sum(sum[:0])
+	}
+
+	var b strings.Builder
+	b.WriteString(magic)
+	b.WriteString(salt)
+	b.WriteByte('$')
+	for _, o := range md5CryptOrder {
+		cryptEncode24(&b, sum[o[0]], sum[o[1]], sum[o[2]], 4)
+	}
+	cryptEncode24(&b, 0, 0, sum[11], 2)
+	return b.String(), nil
+}
+
+// repeatBytes 重复 src 直到长度为 n
+func repeatBytes(src []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, src[:min(len(src), n-len(out))]...)
+	}
+	return out
+}
+
+func cryptEncode24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		b.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
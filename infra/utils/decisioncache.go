@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/coocood/freecache"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// DecisionCache ForwardAuth 认证结果缓存，键为令牌哈希和目标域名，容量满时淘汰最久未使用的记录
+type DecisionCache struct {
+	mu         sync.RWMutex // Set 持有读锁，Clear 持有写锁，保证代数检查和写入之间不会被清空
+	generation uint64
+	cache      *freecache.Cache
+}
+
+func NewDecisionCache(size int) *DecisionCache {
+	return &DecisionCache{cache: freecache.NewCache(size)}
+}
+
+func decisionKey(token, host string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return append(sum[:], host...)
+}
+
+// Get 返回缓存的认证结果，allowed 为 false 时拒绝访问
+func (d *DecisionCache) Get(token, host string) (username string, allowed bool, ok bool) {
+	value, err := d.cache.Get(decisionKey(token, host))
+	if err != nil || len(value) == 0 {
+		return "", false, false
+	}
+	return string(value[1:]), value[0] == '1', true
+}
+
+// Generation 返回当前代数，每次 Clear 加一
+func (d *DecisionCache) Generation() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.generation
+}
+
+// Set 保存认证结果，generation 为认证前取得的代数，期间缓存被清空时不保存
+func (d *DecisionCache) Set(token, host, username string, allowed bool, expire time.Time, generation uint64) {
+	ttl := int(time.Until(expire).Seconds())
+	if ttl < 1 {
+		return
+	}
+	value := []byte("0")
+	if allowed {
+		value = append([]byte("1"), username...)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if generation != d.generation {
+		return
+	}
+	d.cache.Set(decisionKey(token, host), value, ttl)
+}
+
+func (d *DecisionCache) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+	d.cache.Clear()
+}
+
+// WrapSessionStore 吊销会话时清空缓存
+func (d *DecisionCache) WrapSessionStore(store vars.SessionStoreIFace) vars.SessionStoreIFace {
+	return &cachedSessionStore{SessionStoreIFace: store, cache: d}
+}
+
+// WrapUserStore 修改用户时清空缓存，外部用户文件被修改时由 FileUserStore 重新加载后清空
+func (d *DecisionCache) WrapUserStore(store vars.UserStoreIFace) vars.UserStoreIFace {
+	return &cachedUserStore{UserStoreIFace: store, cache: d}
+}
+
+type cachedSessionStore struct {
+	vars.SessionStoreIFace
+	cache *DecisionCache
+}
+
+func (s *cachedSessionStore) Revoke(id string) bool {
+	ok := s.SessionStoreIFace.Revoke(id)
+	s.cache.Clear()
+	return ok
+}
+
+func (s *cachedSessionStore) RevokeUser(username string) int {
+	n := s.SessionStoreIFace.RevokeUser(username)
+	s.cache.Clear()
+	return n
+}
+
+type cachedUserStore struct {
+	vars.UserStoreIFace
+	cache *DecisionCache
+}
+
+func (s *cachedUserStore) Update(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	err := s.UserStoreIFace.Update(fn)
+	s.cache.Clear()
+	return err
+}
+
+func (s *cachedUserStore) ReadOnly() bool {
+	shared, ok := s.UserStoreIFace.(vars.SharedUserStoreIFace)
+	return ok && shared.ReadOnly()
+}
+
+func (s *cachedUserStore) PasswordHashAlgorithm() string {
+	if shared, ok := s.UserStoreIFace.(vars.SharedUserStoreIFace); ok {
+		return shared.PasswordHashAlgorithm()
+	}
+	return ""
+}
+
+func (s *cachedUserStore) RequireHashedPasswords() bool {
+	shared, ok := s.UserStoreIFace.(vars.SharedUserStoreIFace)
+	return ok && shared.RequireHashedPasswords()
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func TestDecisionCacheGeneration(t *testing.T) {
+	expire := time.Now().Add(time.Minute)
+	tests := []struct {
+		name   string
+		clear  bool // 认证过程中缓存被清空
+		wantOK bool
+	}{
+		{"no clear", false, true},
+		{"cleared during authentication", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecisionCache(1024 * 1024)
+			generation := d.Generation()
+			if tt.clear {
+				d.Clear()
+			}
+			d.Set("token", "app.example.com", "alice", true, expire, generation)
+			if _, _, ok := d.Get("token", "app.example.com"); ok != tt.wantOK {
+				t.Errorf("cached = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFileUserStoreReloadClearsAuthCache(t *testing.T) {
+	s, conf := newTestHtpasswdStore(t, false)
+	cache := NewDecisionCache(1024 * 1024)
+	oldCache := vars.AuthCache
+	t.Cleanup(func() { vars.AuthCache = oldCache })
+	vars.AuthCache = cache
+	cache.Set("token", "app.example.com", "bob", true, time.Now().Add(time.Minute), cache.Generation())
+
+	// 外部修改 bob 的密码，重新加载时更换 nonce
+	data := []byte("# shared with nginx\nbob:{PLAIN}changed\n")
+	if err := os.WriteFile(conf.Path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	s.checkedAt = time.Time{}
+	if u, _ := s.Get("bob"); u.Password != "{PLAIN}changed" {
+		t.Fatalf("user file not reloaded, password = %q", u.Password)
+	}
+	if _, _, ok := cache.Get("token", "app.example.com"); ok {
+		t.Error("auth cache not cleared after user file reload")
+	}
+}
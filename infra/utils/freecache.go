@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"time"
 
 	"github.com/coocood/freecache"
@@ -40,3 +41,15 @@ func (f *freeCacheStorage) Set(key, data string, expire time.Time) {
 func (f *freeCacheStorage) Del(key string) {
 	f.cache.Del([]byte(key))
 }
+
+// HealthCheck 写入并读取探测数据，确认缓存可用
+func (f *freeCacheStorage) HealthCheck() error {
+	const probeKey = "__health_probe__"
+	probe := RandString(8)
+	f.Set(probeKey, probe, time.Now().Add(time.Minute))
+	defer f.Del(probeKey)
+	if f.Get(probeKey) != probe {
+		return errors.New("cache read back mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	jweAlgorithm  = "dir"
+	jweEncryption = "A256GCM"
+)
+
+// jweHeader JWE 受保护头部，直接使用对称密钥（dir）加密，cty 表示内容为 JWT
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	ContentType string `json:"cty,omitempty"`
+}
+
+var encodedJWEHeader = mustEncodeJWEHeader()
+
+func mustEncodeJWEHeader() string {
+	data, err := json.Marshal(jweHeader{Algorithm: jweAlgorithm, Encryption: jweEncryption, ContentType: "JWT"})
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// tokenEncryptionMaterials 返回派生加密密钥的原始密钥，第一个用于加密
+// 未设置 token_encryption.key 时使用 secret，轮换后宽限期内的旧密钥仍可用于解密
+func tokenEncryptionMaterials() []string {
+	if key := vars.Config().TokenEncryption.Key; key != "" {
+		return []string{key}
+	}
+	return ActiveSecrets()
+}
+
+// tokenEncryptionAEAD 使用 HKDF-SHA256 派生 256 位 AES-GCM 密钥
+func tokenEncryptionAEAD(material string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, []byte(material), nil, "arkauthn token encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncryptedToken 判断令牌是否为 JWE Compact Serialization（5 段）
+func IsEncryptedToken(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// EncryptToken 将签名后的 JWT 加密为 JWE Compact Serialization
+func EncryptToken(token string) (string, error) {
+	aead, err := tokenEncryptionAEAD(tokenEncryptionMaterials()[0])
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, iv, []byte(token), []byte(encodedJWEHeader))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+	enc := base64.RawURLEncoding
+	return strings.Join([]string{
+		encodedJWEHeader,
+		"", // dir 模式没有加密的内容密钥
+		enc.EncodeToString(iv),
+		enc.EncodeToString(ciphertext),
+		enc.EncodeToString(tag),
+	}, "."), nil
+}
+
+// DecryptToken 解密 EncryptToken 生成的令牌，返回其中的 JWT
+func DecryptToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", ErrInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	headerData, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	var header jweHeader
+	if err := json.Unmarshal(headerData, &header); err != nil || header.Algorithm != jweAlgorithm || header.Encryption != jweEncryption {
+		return "", ErrInvalidToken
+	}
+	iv, err1 := enc.DecodeString(parts[2])
+	ciphertext, err2 := enc.DecodeString(parts[3])
+	tag, err3 := enc.DecodeString(parts[4])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return "", ErrInvalidToken
+	}
+	sealed := append(ciphertext, tag...)
+	for _, material := range tokenEncryptionMaterials() {
+		aead, err := tokenEncryptionAEAD(material)
+		if err != nil {
+			return "", err
+		}
+		if len(iv) != aead.NonceSize() || len(tag) != aead.Overhead() {
+			return "", ErrInvalidToken
+		}
+		// 受保护头部按原样作为附加认证数据
+		if plaintext, err := aead.Open(nil, iv, sealed, []byte(parts[0])); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", ErrInvalidToken
+}
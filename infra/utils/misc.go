@@ -1,10 +1,13 @@
 package utils
 
 import (
+	crand "crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"math/rand/v2"
 	"net"
 	"net/url"
+	"os"
 	"strings"
 
 	"golang.org/x/net/publicsuffix"
@@ -58,3 +61,27 @@ func RandString(n int) string {
 	}
 	return string(result)
 }
+
+// RandToken 返回 32 字节密码学安全随机数的 base64url 编码，用于授权码、会话 ID 等不能被猜测的值
+func RandToken() string {
+	b := make([]byte, 32)
+	crand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CheckDirWritable 通过创建临时文件确认目录可写
+func CheckDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// MatchDomain 判断主机名是否为指定域名或其子域名
+// 例如：a.example.com 匹配 example.com
+func MatchDomain(hostname, domain string) bool {
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	PasswordHashBcrypt       = "bcrypt"
+	PasswordHashArgon2id     = "argon2id"
+	PasswordHashScrypt       = "scrypt"
+	PasswordHashPBKDF2SHA256 = "pbkdf2-sha256"
+	PasswordHashPBKDF2SHA512 = "pbkdf2-sha512"
+
+	passwordHashPlain = "plain"
+)
+
+// 新生成哈希使用的参数，已保存的哈希低于这些参数时会在登录时升级
+const (
+	argon2Memory      = 64 * 1024
+	argon2Time        = 3
+	argon2Threads     = 4
+	scryptLogN        = 15
+	scryptR           = 8
+	scryptP           = 1
+	pbkdf2SHA256Iters = 600000
+	pbkdf2SHA512Iters = 210000
+	passwordSaltLen   = 16
+	passwordKeyLen    = 32
+)
+
+var ErrUnsupportedPasswordHash = errors.New("unsupported password hash")
+
+// PasswordHashAlgorithms 可以配置为新密码使用的哈希算法
+var PasswordHashAlgorithms = []string{
+	PasswordHashBcrypt,
+	PasswordHashArgon2id,
+	PasswordHashScrypt,
+	PasswordHashPBKDF2SHA256,
+	PasswordHashPBKDF2SHA512,
+}
+
+// HashPassword 使用配置的算法生成用于保存到配置中的密码哈希
+func HashPassword(password string) (string, error) {
+	return HashPasswordWith("", password)
+}
+
+// HashPasswordWith 使用指定的算法生成密码哈希，algorithm 为空时使用配置的算法
+func HashPasswordWith(algorithm, password string) (string, error) {
+	if algorithm == "" {
+		algorithm = configuredPasswordHash()
+	}
+	salt := make([]byte, passwordSaltLen)
+	switch algorithm {
+	case PasswordHashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case PasswordHashArgon2id:
+		rand.Read(salt)
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, passwordKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads, phcEncode(salt), phcEncode(key)), nil
+	case PasswordHashScrypt:
+		rand.Read(salt)
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, passwordKeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", scryptLogN, scryptR, scryptP, phcEncode(salt), phcEncode(key)), nil
+	case PasswordHashPBKDF2SHA256, PasswordHashPBKDF2SHA512:
+		newHash, iters := pbkdf2Params(algorithm)
+		rand.Read(salt)
+		key, err := pbkdf2.Key(newHash, password, salt, iters, passwordKeyLen)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$%s$i=%d,l=%d$%s$%s", algorithm, iters, passwordKeyLen, phcEncode(salt), phcEncode(key)), nil
+	}
+	return "", ErrUnsupportedPasswordHash
+}
+
+// VerifyPassword 校验密码与保存的哈希是否匹配
+// 支持 bcrypt、PHC 格式的 argon2id/argon2i/scrypt/pbkdf2、crypt(3) 格式的 SHA-512/SHA-256/MD5，
+// 以及 Dovecot 风格的 {SCHEME} 前缀；无法识别的值按明文比较
+func VerifyPassword(hashed, password string) (bool, error) {
+	return verifyPassword(hashed, password, true)
+}
+
+// VerifyHashedPassword 与 VerifyPassword 相同，但无法识别的格式返回 ErrUnsupportedPasswordHash，明文密码需要 {PLAIN} 前缀
+// 用于与其他服务共用的用户文件，其中 DES-crypt、yescrypt 等格式不能按明文比较，否则输入哈希字符串即可登录
+func VerifyHashedPassword(hashed, password string) (bool, error) {
+	return verifyPassword(hashed, password, false)
+}
+
+func verifyPassword(hashed, password string, allowPlain bool) (bool, error) {
+	if scheme, value, ok := splitDovecotScheme(hashed); ok {
+		switch scheme {
+		case "PLAIN", "CLEARTEXT", "CLEAR":
+			return subtle.ConstantTimeCompare([]byte(password), []byte(value)) == 1, nil
+		case "SHA", "SSHA", "SHA256", "SSHA256", "SHA512", "SSHA512":
+			return verifyDovecotDigest(scheme, value, password)
+		case "CRYPT", "BLF-CRYPT", "SHA512-CRYPT", "SHA256-CRYPT", "MD5-CRYPT", "ARGON2ID", "ARGON2I":
+			if passwordHashScheme(value) == passwordHashPlain {
+				return false, fmt.Errorf("%w: {%s}", ErrUnsupportedPasswordHash, scheme)
+			}
+			hashed = value
+		default:
+			return false, fmt.Errorf("%w: {%s}", ErrUnsupportedPasswordHash, scheme)
+		}
+	}
+	switch passwordHashScheme(hashed) {
+	case PasswordHashBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case PasswordHashArgon2id, "argon2i":
+		return verifyArgon2(hashed, password)
+	case PasswordHashScrypt:
+		return verifyScrypt(hashed, password)
+	case PasswordHashPBKDF2SHA256, PasswordHashPBKDF2SHA512, "pbkdf2-sha1":
+		return verifyPBKDF2(hashed, password)
+	case "sha-crypt", "md5-crypt":
+		return verifyCrypt(hashed, password)
+	case passwordHashPlain:
+		if !allowPlain {
+			return false, ErrUnsupportedPasswordHash
+		}
+		return subtle.ConstantTimeCompare([]byte(password), []byte(hashed)) == 1, nil
+	}
+	return false, ErrUnsupportedPasswordHash
+}
+
+// PasswordNeedsRehash 判断保存的密码是否需要升级为配置的算法和参数
+func PasswordNeedsRehash(hashed string) bool {
+	return PasswordNeedsRehashTo("", hashed)
+}
+
+// PasswordNeedsRehashTo 判断保存的密码是否需要升级为指定的算法和参数，algorithm 为空时使用配置的算法
+func PasswordNeedsRehashTo(algorithm, hashed string) bool {
+	if algorithm == "" {
+		algorithm = configuredPasswordHash()
+	}
+	if strings.HasPrefix(hashed, "{") {
+		return true
+	}
+	scheme := passwordHashScheme(hashed)
+	if scheme != algorithm {
+		return true
+	}
+	switch scheme {
+	case PasswordHashBcrypt:
+		cost, err := bcrypt.Cost([]byte(hashed))
+		return err != nil || cost < bcrypt.DefaultCost
+	case PasswordHashArgon2id:
+		h, err := parsePHC(hashed)
+		return err != nil || h.params["m"] < argon2Memory || h.params["t"] < argon2Time || h.params["p"] < argon2Threads
+	case PasswordHashScrypt:
+		h, err := parsePHC(hashed)
+		return err != nil || h.params["ln"] < scryptLogN || h.params["r"] < scryptR
+	case PasswordHashPBKDF2SHA256, PasswordHashPBKDF2SHA512:
+		h, err := parsePHC(hashed)
+		_, iters := pbkdf2Params(scheme)
+		return err != nil || h.params["i"] < iters
+	}
+	return false
+}
+
+// IsPasswordHash 判断配置中的密码是否为哈希值而不是明文
+func IsPasswordHash(value string) bool {
+	return passwordHashScheme(value) != passwordHashPlain || strings.HasPrefix(value, "{")
+}
+
+var dummyPasswordHashes sync.Map
+
+// SimulateVerifyPassword 用户不存在时使用配置的算法执行一次校验，避免通过响应时间判断用户是否存在
+func SimulateVerifyPassword(password string) {
+	algorithm := configuredPasswordHash()
+	hashed, ok := dummyPasswordHashes.Load(algorithm)
+	if !ok {
+		h, err := HashPassword("dummy_password_for_timing_protection")
+		if err != nil {
+			return
+		}
+		hashed, _ = dummyPasswordHashes.LoadOrStore(algorithm, h)
+	}
+	VerifyPassword(hashed.(string), password)
+}
+
+func configuredPasswordHash() string {
+	if algorithm := vars.Config().PasswordHash.Algorithm; algorithm != "" {
+		return algorithm
+	}
+	return PasswordHashBcrypt
+}
+
+// passwordHashScheme 根据前缀识别哈希格式
+func passwordHashScheme(hashed string) string {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		return PasswordHashBcrypt
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return PasswordHashArgon2id
+	case strings.HasPrefix(hashed, "$argon2i$"):
+		return "argon2i"
+	case strings.HasPrefix(hashed, "$scrypt$"):
+		return PasswordHashScrypt
+	case strings.HasPrefix(hashed, "$pbkdf2-sha256$"):
+		return PasswordHashPBKDF2SHA256
+	case strings.HasPrefix(hashed, "$pbkdf2-sha512$"):
+		return PasswordHashPBKDF2SHA512
+	case strings.HasPrefix(hashed, "$pbkdf2$"), strings.HasPrefix(hashed, "$pbkdf2-sha1$"):
+		return "pbkdf2-sha1"
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		return "sha-crypt"
+	case strings.HasPrefix(hashed, "$1$"), strings.HasPrefix(hashed, "$apr1$"):
+		return "md5-crypt"
+	}
+	return passwordHashPlain
+}
+
+// splitDovecotScheme 拆分 {SHA512-CRYPT}$6$... 形式的 Dovecot 密码
+func splitDovecotScheme(hashed string) (string, string, bool) {
+	if !strings.HasPrefix(hashed, "{") {
+		return "", "", false
+	}
+	end := strings.IndexByte(hashed, '}')
+	if end < 0 {
+		return "", "", false
+	}
+	scheme := strings.ToUpper(hashed[1:end])
+	// 带编码后缀的形式如 {SHA.b64}，只支持默认的 base64
+	scheme = strings.TrimSuffix(scheme, ".B64")
+	return scheme, hashed[end+1:], true
+}
+
+// verifyDovecotDigest 校验 {SHA}、{SSHA} 等 base64 编码的摘要，加盐形式的盐值附加在摘要之后
+func verifyDovecotDigest(scheme, value, password string) (bool, error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false, err
+	}
+	salted := strings.HasPrefix(scheme, "SS")
+	if salted {
+		scheme = scheme[1:]
+	}
+	var newHash func() hash.Hash
+	switch scheme {
+	case "SHA":
+		newHash = sha1.New
+	case "SHA256":
+		newHash = sha256.New
+	case "SHA512":
+		newHash = sha512.New
+	}
+	h := newHash()
+	if len(raw) < h.Size() || (!salted && len(raw) != h.Size()) {
+		return false, ErrUnsupportedPasswordHash
+	}
+	digest, salt := raw[:h.Size()], raw[h.Size():]
+	h.Write([]byte(password))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1, nil
+}
+
+type phcHash struct {
+	id     string
+	params map[string]int
+	salt   []byte
+	hash   []byte
+}
+
+// parsePHC 解析 $id$v=19$k=v,k=v$salt$hash 形式的 PHC 字符串
+// 兼容 passlib 的 $pbkdf2-sha256$rounds$salt$hash 形式
+func parsePHC(s string) (*phcHash, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "$"), "$")
+	if len(parts) < 4 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	h := &phcHash{id: parts[0], params: make(map[string]int)}
+	parts = parts[1:]
+	if strings.HasPrefix(parts[0], "v=") {
+		v, err := strconv.Atoi(parts[0][2:])
+		if err != nil {
+			return nil, ErrUnsupportedPasswordHash
+		}
+		h.params["v"] = v
+		parts = parts[1:]
+	}
+	if len(parts) != 3 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	if n, err := strconv.Atoi(parts[0]); err == nil {
+		h.params["i"] = n
+	} else {
+		for _, kv := range strings.Split(parts[0], ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, ErrUnsupportedPasswordHash
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, ErrUnsupportedPasswordHash
+			}
+			h.params[k] = n
+		}
+	}
+	var err error
+	if h.salt, err = phcDecode(parts[1]); err != nil {
+		return nil, err
+	}
+	if h.hash, err = phcDecode(parts[2]); err != nil {
+		return nil, err
+	}
+	if len(h.hash) == 0 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	return h, nil
+}
+
+func verifyArgon2(hashed, password string) (bool, error) {
+	h, err := parsePHC(hashed)
+	if err != nil {
+		return false, err
+	}
+	m, t, p := h.params["m"], h.params["t"], h.params["p"]
+	if m <= 0 || t <= 0 || p <= 0 || p > 255 {
+		return false, ErrUnsupportedPasswordHash
+	}
+	var key []byte
+	if h.id == "argon2i" {
+		key = argon2.Key([]byte(password), h.salt, uint32(t), uint32(m), uint8(p), uint32(len(h.hash)))
+	} else {
+		key = argon2.IDKey([]byte(password), h.salt, uint32(t), uint32(m), uint8(p), uint32(len(h.hash)))
+	}
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+func verifyScrypt(hashed, password string) (bool, error) {
+	h, err := parsePHC(hashed)
+	if err != nil {
+		return false, err
+	}
+	ln, r, p := h.params["ln"], h.params["r"], h.params["p"]
+	if ln <= 0 || ln > 30 {
+		return false, ErrUnsupportedPasswordHash
+	}
+	key, err := scrypt.Key([]byte(password), h.salt, 1<<ln, r, p, len(h.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+func verifyPBKDF2(hashed, password string) (bool, error) {
+	h, err := parsePHC(hashed)
+	if err != nil {
+		return false, err
+	}
+	newHash, _ := pbkdf2Params(h.id)
+	if h.params["i"] <= 0 {
+		return false, ErrUnsupportedPasswordHash
+	}
+	key, err := pbkdf2.Key(newHash, password, h.salt, h.params["i"], len(h.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, h.hash) == 1, nil
+}
+
+// pbkdf2Params 返回 PBKDF2 使用的摘要算法和新哈希的迭代次数
+func pbkdf2Params(id string) (func() hash.Hash, int) {
+	switch id {
+	case PasswordHashPBKDF2SHA512:
+		return sha512.New, pbkdf2SHA512Iters
+	case PasswordHashPBKDF2SHA256:
+		return sha256.New, pbkdf2SHA256Iters
+	}
+	return sha1.New, pbkdf2SHA256Iters
+}
+
+func phcEncode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// phcDecode 解码 PHC 使用的无填充 base64，兼容 passlib 以 . 代替 + 的编码
+func phcDecode(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.ReplaceAll(s, ".", "+"), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
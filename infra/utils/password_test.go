@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// 已知答案测试，哈希值来自参考实现，不使用本包生成
+func TestVerifyPasswordKnownAnswers(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashed   string
+		password string
+	}{
+		// Ulrich Drepper 的 SHA-crypt 规范中的测试向量，glibc crypt(3) 输出相同
+		{"sha256-crypt", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"sha256-crypt rounds", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"sha512-crypt", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"sha512-crypt rounds", "$6$rounds=1400$anotherlongsalts$5FGyu8c4BZDX4wJgs0Un26YOw2XibT5eTkHF1I1aP3QqStoJI9BHD2YPJYsAjEePVGUyBjdZxcNqMWlrrbIOC.", "Hello world!"},
+		// glibc crypt(3)，显式的默认轮数和 UTF-8 密码
+		{"sha512-crypt default rounds", "$6$rounds=5000$toolongsaltstrin$FYrmJCBmTucL/jC.dn9O5x/bx/uBCTqtlrQMVHHzzdbeVQzYBtJY7wY.y80LLAdt1JWqY7yRM7cRxivgXiqHv1", "pässwörd"},
+		{"md5-crypt glibc", "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "password"},
+		// openssl passwd -1 / -apr1，-apr1 与 htpasswd -m 的输出格式相同
+		{"md5-crypt openssl", "$1$r31.....$1S1.JCfrS0JpsV9gzsADG/", "password"},
+		{"apr1", "$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0", "password"},
+		// OpenBSD bcrypt 测试向量
+		{"bcrypt", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		// phc-winner-argon2 参考实现的测试向量
+		{"argon2id", "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", "password"},
+		{"argon2i", "$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$wWKIMhR9lyDFvRz9YTZweHKfbftvj+qf+YFY4NeBbtA", "password"},
+		{"argon2i 24 bytes", "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG", "password"},
+		// RFC 7914 scrypt 测试向量，按 passlib 的格式编码
+		{"scrypt", "$scrypt$ln=10,r=8,p=16$TmFDbA$/bq+HJ00cgB4VucZDQHp/nxq18vII3gw53N2Y0s3MWIurzDZLiKjiG/xCSedmDDaxyevuUqD7m2DYMvfoswGQA", "password"},
+		// RFC 6070 PBKDF2-HMAC-SHA1 和 RFC 7914 PBKDF2-HMAC-SHA256 测试向量，按 passlib 的 ab64 格式编码
+		{"pbkdf2-sha1 passlib", "$pbkdf2$4096$c2FsdA$SwB5AbdlSJq.rUnZJvch0GWkKcE", "password"},
+		{"pbkdf2-sha256 passlib", "$pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd.8xfHG4RbHjC9UJESBB06GXgw", "passwd"},
+		{"pbkdf2-sha256 phc", "$pbkdf2-sha256$i=1,l=64$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw", "passwd"},
+		// OpenSSL PKCS5_PBKDF2_HMAC（Python hashlib.pbkdf2_hmac）计算
+		{"pbkdf2-sha512 passlib", "$pbkdf2-sha512$1000$c2FsdHNhbHRzYWx0c2FsdA$715rqIr5dXOVPpBhqqsugl037zT5bWJTWYmZtIcK8hBnisKpwfY7kokvwjDrNHqHhF50Pb7MD6HvkJwiDQw4ww", "password"},
+		// htpasswd -s 和 Dovecot 的 {SHA}/{SSHA}，盐值附加在摘要之后
+		{"dovecot sha", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"},
+		{"dovecot ssha", "{SSHA}uJDd0BIdJ9Z7yDCZNWdgYeb33+cBAgME", "secret"},
+		{"dovecot ssha512", "{SSHA512}MKbQg3rPvz03V+1S0+/jlDdn0B0IiGGxl7kZMimdo1IHHWN6DtzxJMCchsX5U1lrRY7apW/oopOgERexYda1nAECAwQ=", "secret"},
+		{"dovecot sha512-crypt", "{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"dovecot plain", "{PLAIN}password", "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyPassword(tt.hashed, tt.password)
+			if err != nil || !ok {
+				t.Errorf("VerifyPassword(%q) = %v, %v, want true", tt.password, ok, err)
+			}
+			ok, err = VerifyPassword(tt.hashed, tt.password+"x")
+			if err != nil || ok {
+				t.Errorf("VerifyPassword(wrong password) = %v, %v, want false", ok, err)
+			}
+		})
+	}
+}
+
+// 共用的用户文件中无法识别的格式不能按明文比较，否则知道哈希字符串即可登录
+func TestVerifyHashedPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashed   string
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{"des-crypt", "rl.3StKT.4T8M", "rl.3StKT.4T8M", false, ErrUnsupportedPasswordHash},
+		{"yescrypt", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$X3DX6M94c7o.9agCG9G317fhZg9SqC.5i5rd.RhAtQ7", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$X3DX6M94c7o.9agCG9G317fhZg9SqC.5i5rd.RhAtQ7", false, ErrUnsupportedPasswordHash},
+		{"bare plaintext", "secret", "secret", false, ErrUnsupportedPasswordHash},
+		{"plain prefix", "{PLAIN}secret", "secret", true, nil},
+		{"bcrypt", "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := VerifyHashedPassword(tt.hashed, tt.password)
+			if ok != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyHashedPassword() = %v, %v, want %v, %v", ok, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	for _, algorithm := range PasswordHashAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			hashed, err := HashPasswordWith(algorithm, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := VerifyPassword(hashed, "correct horse"); err != nil || !ok {
+				t.Errorf("VerifyPassword() = %v, %v, want true", ok, err)
+			}
+			if ok, _ := VerifyPassword(hashed, "wrong horse"); ok {
+				t.Error("VerifyPassword() accepted a wrong password")
+			}
+			if PasswordNeedsRehashTo(algorithm, hashed) {
+				t.Errorf("fresh %s hash needs rehash", algorithm)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	defaultPasswordMinLength   = 8
+	defaultPasswordMinStrength = 2
+)
+
+// PasswordPolicyError 密码不符合策略，Key 为翻译键，Args 为翻译参数
+type PasswordPolicyError struct {
+	Key  string
+	Args []any
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Key
+}
+
+// CheckPasswordPolicy 检查新密码是否符合配置的密码策略
+func CheckPasswordPolicy(username, password string) error {
+	policy := vars.Config().PasswordPolicy
+	minLength := policy.MinLength
+	if minLength <= 0 {
+		minLength = defaultPasswordMinLength
+	}
+	minStrength := policy.MinStrength
+	if minStrength <= 0 {
+		minStrength = defaultPasswordMinStrength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		return &PasswordPolicyError{Key: "password.error.too_short", Args: []any{minLength}}
+	}
+	if strings.EqualFold(password, username) {
+		return &PasswordPolicyError{Key: "password.error.same_as_username"}
+	}
+	if PasswordStrength(password, username) < minStrength {
+		return &PasswordPolicyError{Key: "password.error.too_weak"}
+	}
+	if vars.PwnedPasswords != nil {
+		pwned, err := vars.PwnedPasswords.IsPwned(password)
+		if err != nil {
+			return err
+		}
+		if pwned {
+			return &PasswordPolicyError{Key: "password.error.breached"}
+		}
+	}
+	return nil
+}
+
+// 常见弱密码和单词，包含这些内容的部分只按字典大小计算强度
+var commonPasswordWords = []string{
+	"password", "passw0rd", "qwerty", "qwertyuiop", "asdfgh", "asdfghjkl", "zxcvbn", "zxcvbnm",
+	"1qaz2wsx", "zaq12wsx", "123456", "1234567890", "654321", "111111", "000000", "123123",
+	"abc123", "iloveyou", "letmein", "welcome", "admin", "administrator", "root", "login",
+	"monkey", "dragon", "football", "baseball", "sunshine", "master", "shadow", "superman",
+	"trustno1", "princess", "starwars", "whatever", "freedom", "hello", "secret", "changeme",
+	"default", "guest", "test", "access", "michael", "jennifer", "hunter", "summer", "winter",
+	"spring", "autumn", "woaini", "5201314", "qazwsx", "aa123456", "google", "computer",
+}
+
+// 键盘相邻字符，用于识别 qwerty、asdf 等键盘序列
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// 常见的字母替换，如 p@ssw0rd
+var leetReplacer = strings.NewReplacer("0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// PasswordStrength 估算密码强度，返回 0~4，含义与 zxcvbn 评分一致
+// 按字符集计算每个字符的熵，重复字符、连续序列、键盘序列、常见单词和用户信息会被大幅降权
+func PasswordStrength(password string, userInputs ...string) int {
+	if password == "" {
+		return 0
+	}
+	lower := strings.ToLower(password)
+	normalized := leetReplacer.Replace(lower)
+
+	var bits float64
+	// 常见单词和用户信息按字典大小计算
+	words := commonPasswordWords
+	for _, input := range userInputs {
+		if utf8.RuneCountInString(input) >= 3 {
+			words = append(words, strings.ToLower(input))
+		}
+	}
+	for _, word := range words {
+		if len(word) < 4 && !strings.EqualFold(word, normalized) {
+			continue
+		}
+		// 重复出现的单词几乎不增加强度
+		for n := 0; ; n++ {
+			idx := strings.Index(normalized, word)
+			if idx < 0 {
+				break
+			}
+			mask := strings.Repeat("\x00", len(word))
+			lower = lower[:idx] + mask + lower[idx+len(word):]
+			normalized = normalized[:idx] + mask + normalized[idx+len(word):]
+			if n == 0 {
+				bits += math.Log2(float64(len(words)))
+			} else {
+				bits += 1
+			}
+		}
+	}
+
+	charsetBits := math.Log2(float64(charsetSize(password)))
+	var prev rune = -1
+	for _, r := range lower {
+		if r == 0 {
+			prev = -1
+			continue
+		}
+		if prev >= 0 && (r == prev || r == prev+1 || r == prev-1 || keyboardAdjacent(prev, r)) {
+			bits += 1
+		} else {
+			bits += charsetBits
+		}
+		prev = r
+	}
+
+	switch {
+	case bits < 20:
+		return 0
+	case bits < 30:
+		return 1
+	case bits < 40:
+		return 2
+	case bits < 50:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func charsetSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	return size
+}
+
+func keyboardAdjacent(a, b rune) bool {
+	for _, row := range keyboardRows {
+		ia, ib := strings.IndexRune(row, a), strings.IndexRune(row, b)
+		if ia >= 0 && ib >= 0 && (ia-ib == 1 || ib-ia == 1) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// HIBP 哈希文件每行格式为 SHA1:COUNT，按 SHA1 升序排列
+// 范围文件目录中每个文件以 SHA1 前 5 位命名，每行格式为 后35位:COUNT
+const pwnedPrefixLen = 5
+
+// NewPwnedPasswordChecker 根据路径创建泄露密码检查器
+// 支持 build-pwned-filter 生成的布隆过滤器、按哈希排序的 HIBP 文件以及范围文件目录
+func NewPwnedPasswordChecker(path string) (vars.PwnedPasswordIFace, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return &pwnedRangeDir{dir: path}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == bloomMagic {
+		return LoadBloomFilter(path)
+	}
+	return &pwnedSortedFile{path: path, size: st.Size()}, nil
+}
+
+func passwordSHA1(password string) []byte {
+	sum := sha1.Sum([]byte(password))
+	return sum[:]
+}
+
+// pwnedSortedFile 在按哈希排序的文件中二分查找，不需要将文件读入内存
+type pwnedSortedFile struct {
+	path string
+	size int64
+}
+
+func (p *pwnedSortedFile) IsPwned(password string) (bool, error) {
+	target := strings.ToUpper(hex.EncodeToString(passwordSHA1(password)))
+	f, err := os.Open(p.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// 目标行的起始位置始终位于 [lo, hi) 区间内
+	lo, hi := int64(0), p.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, start, next, err := readLineAt(f, mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		switch cmp := strings.Compare(strings.ToUpper(hash), target); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// readLineAt 返回从 offset 开始（含）的第一个完整行、该行起始位置以及下一行起始位置
+func readLineAt(f *os.File, offset int64) (string, int64, int64, error) {
+	start := offset
+	buf := make([]byte, 128)
+	if offset > 0 {
+		// 前一个字符是换行符时 offset 即为行首，否则跳到下一行开头
+		for {
+			n, err := f.ReadAt(buf, start-1)
+			if idx := bytes.IndexByte(buf[:n], '\n'); idx >= 0 {
+				start += int64(idx)
+				break
+			}
+			start += int64(n)
+			if err != nil {
+				return "", start, start, nil
+			}
+		}
+	}
+	n, err := f.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", start, start, err
+	}
+	line, _, found := bytes.Cut(buf[:n], []byte{'\n'})
+	next := start + int64(len(line))
+	if found {
+		next++
+	}
+	return strings.TrimSpace(string(line)), start, next, nil
+}
+
+// pwnedRangeDir 在 HIBP 范围文件目录中查找
+type pwnedRangeDir struct {
+	dir string
+}
+
+func (p *pwnedRangeDir) IsPwned(password string) (bool, error) {
+	hash := strings.ToUpper(hex.EncodeToString(passwordSHA1(password)))
+	prefix, suffix := hash[:pwnedPrefixLen], hash[pwnedPrefixLen:]
+	f, err := os.Open(filepath.Join(p.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(p.dir, prefix+".txt"))
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(lineSuffix, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+const bloomMagic = "ARKBLOOM"
+
+// BloomFilter 基于密码 SHA-1 的布隆过滤器
+// SHA-1 本身分布均匀，直接取其中两段作为双重哈希的种子
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+// NewBloomFilter 按预计元素数量和误判率创建布隆过滤器
+func NewBloomFilter(n uint64, fpRate float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &BloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (b *BloomFilter) locations(sum []byte) func(i uint32) uint64 {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	return func(i uint32) uint64 {
+		return (h1 + uint64(i)*h2) % b.m
+	}
+}
+
+// AddHash 添加 SHA-1 摘要
+func (b *BloomFilter) AddHash(sum []byte) {
+	loc := b.locations(sum)
+	for i := uint32(0); i < b.k; i++ {
+		pos := loc(i)
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *BloomFilter) containsHash(sum []byte) bool {
+	loc := b.locations(sum)
+	for i := uint32(0); i < b.k; i++ {
+		pos := loc(i)
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BloomFilter) IsPwned(password string) (bool, error) {
+	return b.containsHash(passwordSHA1(password)), nil
+}
+
+// WriteTo 将布隆过滤器写入文件
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint64(header[len(bloomMagic):], b.m)
+	binary.BigEndian.PutUint32(header[len(bloomMagic)+8:], b.k)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 8)
+	for _, word := range b.bits {
+		binary.BigEndian.PutUint64(buf, word)
+		if _, err := bw.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(header) + 8*len(b.bits)), bw.Flush()
+}
+
+// LoadBloomFilter 从文件读取布隆过滤器
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(bloomMagic)]) != bloomMagic {
+		return nil, errors.New("not a bloom filter file")
+	}
+	b := &BloomFilter{
+		m: binary.BigEndian.Uint64(header[len(bloomMagic):]),
+		k: binary.BigEndian.Uint32(header[len(bloomMagic)+8:]),
+	}
+	if b.m == 0 || b.k == 0 {
+		return nil, errors.New("invalid bloom filter header")
+	}
+	b.bits = make([]uint64, (b.m+63)/64)
+	buf := make([]byte, 8)
+	for i := range b.bits {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, fmt.Errorf("read bloom filter: %w", err)
+		}
+		b.bits[i] = binary.BigEndian.Uint64(buf)
+	}
+	return b, nil
+}
+
+// BuildBloomFilter 读取 HIBP 哈希文件（SHA1:COUNT 格式）生成布隆过滤器
+func BuildBloomFilter(input string, fpRate float64) (*BloomFilter, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// 第一遍统计行数，用于计算过滤器大小
+	var n uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	filter := NewBloomFilter(n, fpRate)
+	scanner = bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" {
+			continue
+		}
+		sum, err := hex.DecodeString(hash)
+		if err != nil || len(sum) != sha1.Size {
+			return nil, fmt.Errorf("invalid SHA-1 hash at line %d", line)
+		}
+		filter.AddHash(sum)
+	}
+	return filter, scanner.Err()
+}
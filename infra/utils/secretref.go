@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// envRefPattern 环境变量引用 ${NAME}
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnvRefs 替换字符串中的 ${NAME} 环境变量引用，环境变量不存在时返回错误
+func ExpandEnvRefs(s string) (string, error) {
+	var missing []string
+	result := envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRefPattern.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// ReadSecretFile 读取文件中的敏感配置，去掉末尾的换行
+// 路径支持 ${NAME} 环境变量引用，相对路径在设置了 CREDENTIALS_DIRECTORY（systemd LoadCredential）时相对该目录
+func ReadSecretFile(path string) (string, error) {
+	path, err := ExpandEnvRefs(path)
+	if err != nil {
+		return "", err
+	}
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	WarnWorldReadable(path)
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// WarnWorldReadable 文件可以被其他用户读取时输出警告
+func WarnWorldReadable(path string) {
+	st, err := os.Stat(path)
+	if err == nil && st.Mode().Perm()&0o004 != 0 {
+		logrus.Warnf("%s contains secrets and is readable by other users, run chmod 600 on it", path)
+	}
+}
+
+// ResolveConfigSecrets 解析敏感配置中的 ${NAME} 引用和 *_file 文件
+// 支持 secret、previous_secrets、token_encryption.key、admin_api.keys、introspection.clients 和 users 的密码，原始值按字段路径记录在 SecretRefs 中
+func ResolveConfigSecrets(conf *vars.ConfigFile) error {
+	refs := make(map[string]vars.SecretRef)
+	resolve := func(name string, value *string, file string) error {
+		if file != "" {
+			if *value != "" {
+				return fmt.Errorf("%s and %s_file cannot be used together", name, name)
+			}
+			v, err := ReadSecretFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_file: %w", name, err)
+			}
+			*value = v
+			refs[name] = vars.SecretRef{Value: v}
+			return nil
+		}
+		v, err := ExpandEnvRefs(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if v != *value {
+			refs[name] = vars.SecretRef{Raw: *value, Value: v}
+			*value = v
+		}
+		return nil
+	}
+	if err := resolve("secret", &conf.Secret, conf.SecretFile); err != nil {
+		return err
+	}
+	for i := range conf.PreviousSecrets {
+		p := &conf.PreviousSecrets[i]
+		if err := resolve(SecretRefPath("previous_secrets", i, "secret"), &p.Secret, p.SecretFile); err != nil {
+			return err
+		}
+	}
+	if err := resolve("token_encryption.key", &conf.TokenEncryption.Key, conf.TokenEncryption.KeyFile); err != nil {
+		return err
+	}
+	for i := range conf.AdminAPI.Keys {
+		k := &conf.AdminAPI.Keys[i]
+		if err := resolve(SecretRefPath("admin_api.keys", i, "key"), &k.Key, k.KeyFile); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Introspection.Clients {
+		cl := &conf.Introspection.Clients[i]
+		if err := resolve(SecretRefPath("introspection.clients", i, "client_secret"), &cl.ClientSecret, cl.ClientSecretFile); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Users {
+		u := &conf.Users[i]
+		if err := resolve(SecretRefPath("users", i, "password"), &u.Password, u.PasswordFile); err != nil {
+			return err
+		}
+	}
+	conf.SecretRefs = refs
+	return nil
+}
+
+// SecretRefPath 返回列表 list 中第 i 个元素的 field 字段在 SecretRefs 中的路径
+func SecretRefPath(list string, i int, field string) string {
+	return fmt.Sprintf("%s[%d].%s", list, i, field)
+}
+
+// IsSecretRef 判断 path 字段的值是否从环境变量或文件解析得到，解析后被修改过的值不算
+func IsSecretRef(conf vars.ConfigFile, path, value string) bool {
+	ref, ok := conf.SecretRefs[path]
+	return ok && value != "" && ref.Value == value
+}
+
+// RemapSecretRefs 列表元素移动位置后更新 SecretRefs 中的字段路径，oldIndex[i] 为新列表第 i 个元素原来的位置，新增的元素为 -1
+func RemapSecretRefs(refs map[string]vars.SecretRef, list, field string, oldIndex []int) map[string]vars.SecretRef {
+	prefix := list + "["
+	result := make(map[string]vars.SecretRef, len(refs))
+	for path, ref := range refs {
+		if !strings.HasPrefix(path, prefix) {
+			result[path] = ref
+		}
+	}
+	for i, old := range oldIndex {
+		if ref, ok := refs[SecretRefPath(list, old, field)]; ok && old >= 0 {
+			result[SecretRefPath(list, i, field)] = ref
+		}
+	}
+	return result
+}
+
+// configForSave 返回写入配置文件的内容，从引用解析出的值恢复为原始引用，避免敏感信息写入配置文件
+// 值被修改过（如修改了密码）时写入新值，并去掉对应的 *_file
+func configForSave(conf vars.ConfigFile) vars.ConfigFile {
+	restore := func(path string, value, file *string) {
+		if IsSecretRef(conf, path, *value) {
+			*value = conf.SecretRefs[path].Raw
+		} else {
+			*file = ""
+		}
+	}
+	restore("secret", &conf.Secret, &conf.SecretFile)
+	conf.PreviousSecrets = slices.Clone(conf.PreviousSecrets)
+	for i := range conf.PreviousSecrets {
+		restore(SecretRefPath("previous_secrets", i, "secret"), &conf.PreviousSecrets[i].Secret, &conf.PreviousSecrets[i].SecretFile)
+	}
+	restore("token_encryption.key", &conf.TokenEncryption.Key, &conf.TokenEncryption.KeyFile)
+	conf.AdminAPI.Keys = slices.Clone(conf.AdminAPI.Keys)
+	for i := range conf.AdminAPI.Keys {
+		restore(SecretRefPath("admin_api.keys", i, "key"), &conf.AdminAPI.Keys[i].Key, &conf.AdminAPI.Keys[i].KeyFile)
+	}
+	conf.Introspection.Clients = slices.Clone(conf.Introspection.Clients)
+	for i := range conf.Introspection.Clients {
+		restore(SecretRefPath("introspection.clients", i, "client_secret"), &conf.Introspection.Clients[i].ClientSecret, &conf.Introspection.Clients[i].ClientSecretFile)
+	}
+	conf.Users = slices.Clone(conf.Users)
+	for i := range conf.Users {
+		restore(SecretRefPath("users", i, "password"), &conf.Users[i].Password, &conf.Users[i].PasswordFile)
+	}
+	return conf
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// savedUsers 在临时目录中修改用户并保存配置，返回写入配置文件的用户
+func savedUsers(t *testing.T, conf vars.ConfigFile, fn func([]vars.UserItem) ([]vars.UserItem, error)) []vars.UserItem {
+	t.Helper()
+	if err := ResolveConfigSecrets(&conf); err != nil {
+		t.Fatal(err)
+	}
+	oldConfig, oldPath := *vars.Config(), vars.ConfigPath
+	t.Cleanup(func() {
+		vars.SetConfig(oldConfig)
+		vars.ConfigPath = oldPath
+	})
+	vars.SetConfig(conf)
+	vars.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	if err := NewConfigUserStore().Update(fn); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(vars.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved vars.ConfigFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved.Users
+}
+
+func TestSecretRefsSave(t *testing.T) {
+	t.Setenv("ARK_TEST_PASSWORD", "shared")
+	pwFile := writeTempFile(t, "bob.pw", "bobpass\n")
+	users := func() []vars.UserItem {
+		return []vars.UserItem{
+			{Username: "alice", Password: "${ARK_TEST_PASSWORD}"},
+			{Username: "bob", PasswordFile: pwFile},
+			{Username: "carol", Password: "shared"},
+		}
+	}
+	keep := func(users []vars.UserItem) ([]vars.UserItem, error) { return users, nil }
+	tests := []struct {
+		name string
+		fn   func([]vars.UserItem) ([]vars.UserItem, error)
+		want []vars.UserItem
+	}{
+		{
+			name: "inline value equal to a resolved one",
+			fn:   keep,
+			want: users(),
+		},
+		{
+			name: "delete user before a file reference",
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				return users[1:], nil
+			},
+			want: users()[1:],
+		},
+		{
+			name: "change password read from file",
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				users[1].Password = "newpass"
+				return users, nil
+			},
+			want: []vars.UserItem{
+				{Username: "alice", Password: "${ARK_TEST_PASSWORD}"},
+				{Username: "bob", Password: "newpass"},
+				{Username: "carol", Password: "shared"},
+			},
+		},
+		{
+			name: "set password to the resolved value of another user",
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				users[1].Password = "shared"
+				return users, nil
+			},
+			want: []vars.UserItem{
+				{Username: "alice", Password: "${ARK_TEST_PASSWORD}"},
+				{Username: "bob", Password: "shared"},
+				{Username: "carol", Password: "shared"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := savedUsers(t, vars.ConfigFile{Users: users()}, tt.fn)
+			if !slices.EqualFunc(got, tt.want, func(a, b vars.UserItem) bool {
+				return a.Username == b.Username && a.Password == b.Password && a.PasswordFile == b.PasswordFile
+			}) {
+				t.Errorf("saved users = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSecretRefByPath(t *testing.T) {
+	t.Setenv("ARK_TEST_SECRET", "shared")
+	conf := vars.ConfigFile{
+		Secret:   "${ARK_TEST_SECRET}",
+		AdminAPI: vars.AdminAPI{Keys: []vars.APIKeyItem{{Name: "ci", Key: "shared"}}},
+	}
+	if err := ResolveConfigSecrets(&conf); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSecretRef(conf, "secret", conf.Secret) {
+		t.Error("secret should be a reference")
+	}
+	if IsSecretRef(conf, SecretRefPath("admin_api.keys", 0, "key"), conf.AdminAPI.Keys[0].Key) {
+		t.Error("inline api key with the same value as secret should not be a reference")
+	}
+}
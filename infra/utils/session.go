@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// MemorySessionStore 在内存中记录已签发的会话，过期的会话会被自动清理
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]vars.Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]vars.Session),
+	}
+}
+
+func (s *MemorySessionStore) Create(session vars.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanup()
+	s.sessions[session.ID] = session
+}
+
+// List 返回指定用户的有效会话，username 为空时返回全部
+func (s *MemorySessionStore) List(username string) []vars.Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	var result []vars.Session
+	for _, session := range s.sessions {
+		if session.ExpiresAt.Before(now) || (username != "" && session.Username != username) {
+			continue
+		}
+		result = append(result, session)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].IssuedAt.After(result[j].IssuedAt) })
+	return result
+}
+
+func (s *MemorySessionStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return false
+	}
+	session.Revoked = true
+	s.sessions[id] = session
+	return true
+}
+
+func (s *MemorySessionStore) RevokeUser(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, session := range s.sessions {
+		if session.Username == username && !session.Revoked {
+			session.Revoked = true
+			s.sessions[id] = session
+			count++
+		}
+	}
+	return count
+}
+
+func (s *MemorySessionStore) IsRevoked(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions[id].Revoked
+}
+
+// Extend 更新会话的过期时间，用于滑动续期
+func (s *MemorySessionStore) Extend(id string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		session.ExpiresAt = expiresAt
+		s.sessions[id] = session
+	}
+}
+
+// cleanup 清理已过期的会话，调用方需持有写锁
+func (s *MemorySessionStore) cleanup() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// SaveState 将会话记录写入文件，重启后吊销状态依然有效
+func (s *MemorySessionStore) SaveState(path string) error {
+	s.mu.Lock()
+	s.cleanup()
+	data, err := json.Marshal(s.sessions)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadState 从文件恢复会话记录并与内存中的记录合并，任一方吊销的会话保持吊销，文件不存在时忽略
+// 平滑重启时新进程先读取旧进程交接前保存的状态，旧进程退出后再合并其最终状态
+func (s *MemorySessionStore) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var sessions map[string]vars.Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range sessions {
+		if current, ok := s.sessions[id]; ok {
+			session.Revoked = session.Revoked || current.Revoked
+			if current.ExpiresAt.After(session.ExpiresAt) {
+				session.ExpiresAt = current.ExpiresAt
+			}
+		}
+		s.sessions[id] = session
+	}
+	s.cleanup()
+	return nil
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// 平滑重启时新进程先读取交接前的状态，旧进程退出后再合并其最终状态
+func TestMemorySessionStoreMergeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	now := time.Now()
+	session := func(id string) vars.Session {
+		return vars.Session{ID: id, Username: "alice", IssuedAt: now, ExpiresAt: now.Add(time.Hour)}
+	}
+
+	parent := NewMemorySessionStore()
+	for _, id := range []string{"s1", "s2", "s3"} {
+		parent.Create(session(id))
+	}
+	if err := parent.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	child := NewMemorySessionStore()
+	if err := child.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 交接后旧进程吊销 s1 并签发 s4，新进程吊销 s2 并签发 s5
+	parent.Revoke("s1")
+	parent.Create(session("s4"))
+	child.Revoke("s2")
+	child.Create(session("s5"))
+	if err := parent.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id          string
+		wantRevoked bool
+	}{
+		{"s1", true},
+		{"s2", true},
+		{"s3", false},
+		{"s4", false},
+		{"s5", false},
+	}
+	for _, tt := range tests {
+		if got := child.IsRevoked(tt.id); got != tt.wantRevoked {
+			t.Errorf("IsRevoked(%s) = %v, want %v", tt.id, got, tt.wantRevoked)
+		}
+	}
+	if n := len(child.List("alice")); n != len(tests) {
+		t.Errorf("sessions = %d, want %d", n, len(tests))
+	}
+}
+
+func TestErrorSlidingWindowLimiterMergeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jail.json")
+	parent := NewErrorSlidingWindowLimiter(3, time.Hour)
+	parent.RecordError("10.0.0.1")
+	if err := parent.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	child := NewErrorSlidingWindowLimiter(3, time.Hour)
+	if err := child.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	parent.RecordError("10.0.0.1")
+	child.RecordError("10.0.0.1")
+	if err := parent.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if !child.IsLimited("10.0.0.1") {
+		t.Error("errors recorded by both processes should be merged")
+	}
+}
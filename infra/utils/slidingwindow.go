@@ -1,8 +1,14 @@
 package utils
 
 import (
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
 )
 
 // ErrorSlidingWindowLimiter 实现了一个基于滑动窗口的错误尝试限流器。
@@ -38,7 +44,7 @@ func (l *ErrorSlidingWindowLimiter) IsLimited(ip string) bool {
 		for firstValid < len(errors) && errors[firstValid].Before(cutoff) {
 			firstValid++
 		}
-		
+
 		// 如果有过期记录，切片并更新回Map
 		if firstValid > 0 {
 			errors = errors[firstValid:]
@@ -48,7 +54,7 @@ func (l *ErrorSlidingWindowLimiter) IsLimited(ip string) bool {
 		// 如果当前窗口内的错误数量达到最大值，则返回true表示被限流
 		return len(errors) >= l.maxErrors
 	}
-	
+
 	return false
 }
 
@@ -66,3 +72,91 @@ func (l *ErrorSlidingWindowLimiter) RecordError(ip string) {
 		l.errors.Store(ip, []time.Time{time.Now()})
 	}
 }
+
+// SaveState 将当前的错误记录写入文件，用于服务重启后恢复
+func (l *ErrorSlidingWindowLimiter) SaveState(path string) error {
+	l.mu.Lock()
+	state := make(map[string][]time.Time)
+	cutoff := time.Now().Add(-l.window)
+	l.errors.Range(func(key, value any) bool {
+		var valid []time.Time
+		for _, t := range value.([]time.Time) {
+			if !t.Before(cutoff) {
+				valid = append(valid, t)
+			}
+		}
+		if len(valid) > 0 {
+			state[key.(string)] = valid
+		}
+		return true
+	})
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadState 从文件恢复错误记录并与内存中的记录合并，文件不存在时忽略
+func (l *ErrorSlidingWindowLimiter) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state map[string][]time.Time
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, errors := range state {
+		if current, ok := l.errors.Load(ip); ok {
+			errors = append(errors, current.([]time.Time)...)
+			sort.Slice(errors, func(i, j int) bool { return errors[i].Before(errors[j]) })
+			errors = slices.CompactFunc(errors, time.Time.Equal)
+		}
+		l.errors.Store(ip, errors)
+	}
+	return nil
+}
+
+// Jailed 返回当前被限制登录的 IP 列表
+func (l *ErrorSlidingWindowLimiter) Jailed() []vars.JailedIP {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := time.Now().Add(-l.window)
+	var result []vars.JailedIP
+	l.errors.Range(func(key, value any) bool {
+		errors := value.([]time.Time)
+		var valid []time.Time
+		for _, t := range errors {
+			if !t.Before(cutoff) {
+				valid = append(valid, t)
+			}
+		}
+		if len(valid) >= l.maxErrors {
+			// 最早的一次有效错误过期后才会解除限制
+			result = append(result, vars.JailedIP{
+				IP:       key.(string),
+				Failures: len(valid),
+				Until:    valid[len(valid)-l.maxErrors].Add(l.window),
+			})
+		}
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Until.After(result[j].Until) })
+	return result
+}
+
+// Unban 清除指定 IP 的错误记录
+func (l *ErrorSlidingWindowLimiter) Unban(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors.Delete(ip)
+}
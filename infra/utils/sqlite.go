@@ -0,0 +1,461 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// sqliteDriverName 由 modernc.org/sqlite 注册
+const sqliteDriverName = "sqlite"
+
+const (
+	defaultAuditRetention = 90
+	auditCleanupInterval  = time.Hour
+)
+
+// sqliteMigrations 数据库结构变更，按顺序执行，已执行的版本记录在 user_version 中
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		username TEXT PRIMARY KEY,
+		password TEXT NOT NULL,
+		nonce    TEXT NOT NULL DEFAULT '',
+		admin    INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE sessions (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		ip         TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		issued_at  INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		revoked    INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessions_username ON sessions (username);
+	CREATE INDEX sessions_expires_at ON sessions (expires_at);
+	CREATE TABLE api_keys (
+		key_hash   TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE mfa_secrets (
+		username   TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		secret     TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (username, type)
+	);
+	CREATE TABLE audit_events (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		time     INTEGER NOT NULL,
+		type     TEXT NOT NULL,
+		username TEXT NOT NULL DEFAULT '',
+		ip       TEXT NOT NULL DEFAULT '',
+		detail   TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX audit_events_time ON audit_events (time);`,
+	`ALTER TABLE users ADD COLUMN user_groups TEXT NOT NULL DEFAULT '[]';`,
+	`ALTER TABLE users ADD COLUMN password_fingerprint TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLiteStore 将用户、会话、管理接口密钥、MFA 密钥和审计事件保存在 SQLite 数据库中
+type SQLiteStore struct {
+	db         *sql.DB
+	Users      *SQLiteUserStore
+	Sessions   *SQLiteSessionStore
+	Audit      *SQLiteAuditLog
+	APIKeys    *SQLiteAPIKeyStore
+	MFASecrets *SQLiteMFASecretStore
+}
+
+type SQLiteUserStore struct{ db *sql.DB }
+
+type SQLiteSessionStore struct{ db *sql.DB }
+
+type SQLiteAPIKeyStore struct{ db *sql.DB }
+
+type SQLiteMFASecretStore struct{ db *sql.DB }
+
+type SQLiteAuditLog struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu        sync.Mutex
+	cleanedAt time.Time
+}
+
+func NewSQLiteStore(conf vars.Database) (*SQLiteStore, error) {
+	db, err := sql.Open(sqliteDriverName, conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 同一时间只允许一个写入者，使用单个连接避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA synchronous = NORMAL",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	retention := conf.AuditRetention
+	if retention <= 0 {
+		retention = defaultAuditRetention
+	}
+	return &SQLiteStore{
+		db:         db,
+		Users:      &SQLiteUserStore{db: db},
+		Sessions:   &SQLiteSessionStore{db: db},
+		Audit:      &SQLiteAuditLog{db: db, retention: time.Duration(retention) * 24 * time.Hour},
+		APIKeys:    &SQLiteAPIKeyStore{db: db},
+		MFASecrets: &SQLiteMFASecretStore{db: db},
+	}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate database to version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// HealthCheck 检查数据库是否可以访问
+func (s *SQLiteStore) HealthCheck() error {
+	return s.db.Ping()
+}
+
+func (s *SQLiteUserStore) Get(username string) (vars.UserItem, bool) {
+	u, err := scanUser(s.db.QueryRow("SELECT username, password, nonce, password_fingerprint, admin, user_groups FROM users WHERE username = ?", username))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("Query user %s failed: %v", username, err)
+		}
+		return vars.UserItem{}, false
+	}
+	return u, true
+}
+
+func (s *SQLiteUserStore) List() []vars.UserItem {
+	users, err := listUsers(s.db)
+	if err != nil {
+		logrus.Errorf("List users failed: %v", err)
+	}
+	return users
+}
+
+type sqlQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func listUsers(q sqlQueryer) ([]vars.UserItem, error) {
+	rows, err := q.Query("SELECT username, password, nonce, password_fingerprint, admin, user_groups FROM users ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []vars.UserItem
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func scanUser(row interface{ Scan(dest ...any) error }) (vars.UserItem, error) {
+	var u vars.UserItem
+	var groups string
+	if err := row.Scan(&u.Username, &u.Password, &u.Nonce, &u.PasswordFingerprint, &u.Admin, &groups); err != nil {
+		return u, err
+	}
+	if err := json.Unmarshal([]byte(groups), &u.Groups); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// Update 在事务中修改用户，只写入有变化的记录
+func (s *SQLiteUserStore) Update(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	old, err := listUsers(tx)
+	if err != nil {
+		return err
+	}
+	oldByName := make(map[string]vars.UserItem, len(old))
+	for _, u := range old {
+		oldByName[u.Username] = u
+	}
+	users, err := fn(slices.Clone(old))
+	if err != nil {
+		return err
+	}
+	setChangedPasswordFingerprints(vars.Config().Secret, old, users)
+	for _, u := range users {
+		if prev, ok := oldByName[u.Username]; ok && reflect.DeepEqual(prev, u) {
+			delete(oldByName, u.Username)
+			continue
+		}
+		delete(oldByName, u.Username)
+		groups, err := json.Marshal(u.Groups)
+		if err != nil {
+			return err
+		}
+		if u.Groups == nil {
+			groups = []byte("[]")
+		}
+		_, err = tx.Exec(`INSERT INTO users (username, password, nonce, password_fingerprint, admin, user_groups) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (username) DO UPDATE SET password = excluded.password, nonce = excluded.nonce,
+				password_fingerprint = excluded.password_fingerprint, admin = excluded.admin, user_groups = excluded.user_groups`,
+			u.Username, u.Password, u.Nonce, u.PasswordFingerprint, u.Admin, string(groups))
+		if err != nil {
+			return err
+		}
+	}
+	for username := range oldByName {
+		if _, err := tx.Exec("DELETE FROM users WHERE username = ?", username); err != nil {
+			return err
+		}
+		// 删除用户时一并删除其 MFA 密钥，避免同名的新用户继承
+		if _, err := tx.Exec("DELETE FROM mfa_secrets WHERE username = ?", username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CheckPasswordFingerprints 启动时检查用户的密码指纹，直接修改数据库中的密码后更换 Nonce 使已签发的令牌失效
+func (s *SQLiteUserStore) CheckPasswordFingerprints() error {
+	return s.Update(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		rotated, _ := CheckPasswordFingerprints(ActiveSecrets(), users)
+		for _, username := range rotated {
+			logrus.Infof("Password of %s changed in database, issued tokens are revoked", username)
+		}
+		return users, nil
+	})
+}
+
+func (s *SQLiteSessionStore) Create(session vars.Session) {
+	now := time.Now().Unix()
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		logrus.Errorf("Cleanup sessions failed: %v", err)
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (id, username, ip, user_agent, issued_at, expires_at, revoked)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.Username, session.IP, session.UserAgent, session.IssuedAt.Unix(), session.ExpiresAt.Unix(), session.Revoked)
+	if err != nil {
+		logrus.Errorf("Create session failed: %v", err)
+	}
+}
+
+// List 返回指定用户的有效会话，username 为空时返回全部
+func (s *SQLiteSessionStore) List(username string) []vars.Session {
+	query := "SELECT id, username, ip, user_agent, issued_at, expires_at, revoked FROM sessions WHERE expires_at >= ?"
+	args := []any{time.Now().Unix()}
+	if username != "" {
+		query += " AND username = ?"
+		args = append(args, username)
+	}
+	rows, err := s.db.Query(query+" ORDER BY issued_at DESC", args...)
+	if err != nil {
+		logrus.Errorf("List sessions failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var result []vars.Session
+	for rows.Next() {
+		var session vars.Session
+		var issuedAt, expiresAt int64
+		if err := rows.Scan(&session.ID, &session.Username, &session.IP, &session.UserAgent, &issuedAt, &expiresAt, &session.Revoked); err != nil {
+			logrus.Errorf("List sessions failed: %v", err)
+			return result
+		}
+		session.IssuedAt, session.ExpiresAt = time.Unix(issuedAt, 0), time.Unix(expiresAt, 0)
+		result = append(result, session)
+	}
+	return result
+}
+
+func (s *SQLiteSessionStore) Revoke(id string) bool {
+	res, err := s.db.Exec("UPDATE sessions SET revoked = 1 WHERE id = ?", id)
+	if err != nil {
+		logrus.Errorf("Revoke session %s failed: %v", id, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (s *SQLiteSessionStore) RevokeUser(username string) int {
+	res, err := s.db.Exec("UPDATE sessions SET revoked = 1 WHERE username = ? AND revoked = 0", username)
+	if err != nil {
+		logrus.Errorf("Revoke sessions of %s failed: %v", username, err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+// Extend 更新会话的过期时间，用于滑动续期
+func (s *SQLiteSessionStore) Extend(id string, expiresAt time.Time) {
+	if _, err := s.db.Exec("UPDATE sessions SET expires_at = ? WHERE id = ?", expiresAt.Unix(), id); err != nil {
+		logrus.Errorf("Extend session %s failed: %v", id, err)
+	}
+}
+
+// IsRevoked 查询失败时视为已吊销，数据库不可用时不能放行可能已被吊销的会话
+func (s *SQLiteSessionStore) IsRevoked(id string) bool {
+	var revoked bool
+	err := s.db.QueryRow("SELECT revoked FROM sessions WHERE id = ?", id).Scan(&revoked)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		logrus.Errorf("Query session %s failed: %v", id, err)
+		return true
+	}
+	return revoked
+}
+
+func (s *SQLiteAuditLog) Record(event vars.AuditEvent) {
+	_, err := s.db.Exec("INSERT INTO audit_events (time, type, username, ip, detail) VALUES (?, ?, ?, ?, ?)",
+		event.Time.UnixMilli(), event.Type, event.Username, event.IP, event.Detail)
+	if err != nil {
+		logrus.Errorf("Record audit event failed: %v", err)
+	}
+	s.mu.Lock()
+	needCleanup := time.Since(s.cleanedAt) > auditCleanupInterval
+	if needCleanup {
+		s.cleanedAt = time.Now()
+	}
+	s.mu.Unlock()
+	if needCleanup {
+		before := time.Now().Add(-s.retention).UnixMilli()
+		if _, err := s.db.Exec("DELETE FROM audit_events WHERE time < ?", before); err != nil {
+			logrus.Errorf("Cleanup audit events failed: %v", err)
+		}
+	}
+}
+
+// Recent 按时间倒序返回最近的 n 条事件
+func (s *SQLiteAuditLog) Recent(n int) []vars.AuditEvent {
+	if n <= 0 {
+		n = -1
+	}
+	rows, err := s.db.Query("SELECT time, type, username, ip, detail FROM audit_events ORDER BY id DESC LIMIT ?", n)
+	if err != nil {
+		logrus.Errorf("Query audit events failed: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var result []vars.AuditEvent
+	for rows.Next() {
+		var event vars.AuditEvent
+		var ms int64
+		if err := rows.Scan(&ms, &event.Type, &event.Username, &event.IP, &event.Detail); err != nil {
+			logrus.Errorf("Query audit events failed: %v", err)
+			return result
+		}
+		event.Time = time.UnixMilli(ms)
+		result = append(result, event)
+	}
+	return result
+}
+
+// AddAPIKey 保存管理接口密钥，数据库中只保存密钥的 SHA-256
+func (s *SQLiteAPIKeyStore) AddAPIKey(item vars.APIKeyItem) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO api_keys (key_hash, name, created_at) VALUES (?, ?, ?)",
+		apiKeyHash(item.Key), item.Name, time.Now().Unix())
+	return err
+}
+
+func (s *SQLiteAPIKeyStore) LookupAPIKey(key string) (string, bool) {
+	var name string
+	err := s.db.QueryRow("SELECT name FROM api_keys WHERE key_hash = ?", apiKeyHash(key)).Scan(&name)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("Query api key failed: %v", err)
+		}
+		return "", false
+	}
+	return name, true
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetMFASecret 返回用户指定类型（如 totp、webauthn）的 MFA 密钥，不存在时 ok 为 false
+func (s *SQLiteMFASecretStore) GetMFASecret(username, typ string) (string, bool, error) {
+	var secret string
+	err := s.db.QueryRow("SELECT secret FROM mfa_secrets WHERE username = ? AND type = ?", username, typ).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return secret, true, nil
+}
+
+// SetMFASecret 保存用户的 MFA 密钥，同类型的旧密钥被替换
+func (s *SQLiteMFASecretStore) SetMFASecret(username, typ, secret string) error {
+	_, err := s.db.Exec(`INSERT INTO mfa_secrets (username, type, secret, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, type) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at`,
+		username, typ, secret, time.Now().Unix())
+	return err
+}
+
+// DeleteMFASecret 删除用户的 MFA 密钥，typ 为空时删除全部类型
+func (s *SQLiteMFASecretStore) DeleteMFASecret(username, typ string) error {
+	if typ == "" {
+		_, err := s.db.Exec("DELETE FROM mfa_secrets WHERE username = ?", username)
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM mfa_secrets WHERE username = ? AND type = ?", username, typ)
+	return err
+}
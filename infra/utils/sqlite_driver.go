@@ -0,0 +1,4 @@
+package utils
+
+// 纯 Go 实现的 SQLite 驱动，注册为 "sqlite"，不需要 cgo
+import _ "modernc.org/sqlite"
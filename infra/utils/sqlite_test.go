@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(vars.Database{Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteMFASecrets(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	err := store.Users.Update(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		return append(users, vars.UserItem{Username: "alice", Password: "x"}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa := store.MFASecrets
+	if _, ok, err := mfa.GetMFASecret("alice", "totp"); ok || err != nil {
+		t.Fatalf("GetMFASecret() before set = %v, %v", ok, err)
+	}
+	for _, secret := range []string{"JBSWY3DPEHPK3PXP", "KRSXG5CTMVRXEZLU"} {
+		if err := mfa.SetMFASecret("alice", "totp", secret); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := mfa.GetMFASecret("alice", "totp"); !ok || err != nil || got != secret {
+			t.Errorf("GetMFASecret() = %q, %v, %v, want %q", got, ok, err, secret)
+		}
+	}
+
+	// 删除用户后同名的新用户不能继承 MFA 密钥
+	err = store.Users.Update(func([]vars.UserItem) ([]vars.UserItem, error) { return nil, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := mfa.GetMFASecret("alice", "totp"); ok || err != nil {
+		t.Errorf("GetMFASecret() after user deleted = %v, %v, want not found", ok, err)
+	}
+
+	if err := mfa.SetMFASecret("bob", "totp", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfa.SetMFASecret("bob", "recovery", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfa.DeleteMFASecret("bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := mfa.GetMFASecret("bob", "recovery"); ok {
+		t.Error("DeleteMFASecret() with empty type should delete all types")
+	}
+}
+
+func TestSQLiteSessionRevokedFailsClosed(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	now := time.Now()
+	store.Sessions.Create(vars.Session{ID: "s1", Username: "alice", IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if store.Sessions.IsRevoked("s1") || store.Sessions.IsRevoked("unknown") {
+		t.Fatal("active and unknown sessions should not be revoked")
+	}
+	store.Sessions.Revoke("s1")
+	if !store.Sessions.IsRevoked("s1") {
+		t.Error("revoked session is not revoked")
+	}
+	// 数据库不可用时拒绝，而不是放行
+	store.Close()
+	if !store.Sessions.IsRevoked("unknown") {
+		t.Error("IsRevoked() should fail closed when the query fails")
+	}
+}
+
+func TestSQLitePasswordFingerprints(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	err := store.Users.Update(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		return append(users, vars.UserItem{Username: "alice", Password: "x", Nonce: "n1"}), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users.CheckPasswordFingerprints(); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.Users.Get("alice"); u.Nonce != "n1" || u.PasswordFingerprint == "" {
+		t.Fatalf("alice = nonce %q fingerprint %q, want nonce n1 with fingerprint", u.Nonce, u.PasswordFingerprint)
+	}
+	// 直接修改数据库中的密码，启动时更换 Nonce
+	if _, err := store.db.Exec("UPDATE users SET password = 'y' WHERE username = 'alice'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Users.CheckPasswordFingerprints(); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := store.Users.Get("alice")
+	if u.Nonce == "n1" {
+		t.Error("nonce not rotated after password changed in database")
+	}
+	if err := store.Users.CheckPasswordFingerprints(); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.Users.Get("alice"); again.Nonce != u.Nonce {
+		t.Errorf("nonce rotated again: %q -> %q", u.Nonce, again.Nonce)
+	}
+}
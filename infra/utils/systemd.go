@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// SdListenFdsStart 继承的第一个文件描述符编号，与 systemd 约定一致，平滑重启传递监听器时使用相同的编号
+const SdListenFdsStart = 3
+
+// InheritedListeners 返回从父进程继承的监听器，没有时返回空列表
+// 支持 systemd socket activation（LISTEN_PID/LISTEN_FDS）
+// 以及平滑重启时由旧进程传入的监听器（ARKAUTHN_LISTEN_FDS）
+func InheritedListeners() ([]net.Listener, error) {
+	handoffEnv := vars.APP_NAME + "_LISTEN_FDS"
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(handoffEnv)
+	}()
+	nfds, err := strconv.Atoi(os.Getenv(handoffEnv))
+	if err != nil || nfds <= 0 {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return nil, nil
+		}
+		nfds, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || nfds <= 0 {
+			return nil, nil
+		}
+	}
+	listeners := make([]net.Listener, 0, nfds)
+	for fd := SdListenFdsStart; fd < SdListenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// SdNotify 向 systemd 发送状态通知，例如 READY=1、WATCHDOG=1
+// 未由 systemd 以 Type=notify 启动时返回 false
+func SdNotify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// 以 @ 开头表示抽象命名空间
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdogInterval 返回 systemd 要求的看门狗超时时间，未启用时返回 0
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
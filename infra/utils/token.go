@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -18,83 +21,121 @@ var (
 // 自定义JWT声明结构
 type Claims struct {
 	Username string `json:"user"`
+	// AuthTime 登录时间，续期后保持不变
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// MaxExpiresAt 滑动续期的最长有效期，为空时令牌不续期
+	MaxExpiresAt *jwt.NumericDate `json:"max_exp,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // GenerateToken 生成JWT令牌
 // username: 用户名
+// sessionID: 会话ID，写入 jti 用于会话管理和吊销
 // expireDuration: 过期时间，如果为0则使用默认过期时间(24小时)
-func GenerateToken(username string, expireDuration time.Duration) (string, error) {
+// maxDuration: 滑动续期的最长有效期，为0时令牌不续期
+func GenerateToken(username, sessionID string, expireDuration, maxDuration time.Duration) (string, error) {
 	// 如果未指定过期时间，默认24小时
 	if expireDuration == 0 {
 		expireDuration = 24 * time.Hour
 	}
 
 	// 设置JWT声明
+	now := time.Now()
 	claims := Claims{
 		Username: username,
+		AuthTime: jwt.NewNumericDate(now),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expireDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(expireDuration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
+	if maxDuration > 0 {
+		claims.MaxExpiresAt = jwt.NewNumericDate(now.Add(maxDuration))
+	}
+	return signToken(&claims)
+}
+
+// RenewToken 以新的过期时间重新签发令牌，会话ID、登录时间和最长有效期保持不变
+func RenewToken(claims *Claims, expireAt time.Time) (string, error) {
+	renewed := *claims
+	now := time.Now()
+	renewed.ExpiresAt = jwt.NewNumericDate(expireAt)
+	renewed.IssuedAt = jwt.NewNumericDate(now)
+	renewed.NotBefore = jwt.NewNumericDate(now)
+	return signToken(&renewed)
+}
 
-	// 创建令牌
+func signToken(claims *Claims) (string, error) {
+	// 创建令牌，kid 标识签名使用的密钥，密钥轮换后仍能找到对应的旧密钥
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = SecretKeyID(vars.Config().Secret)
 
 	// 签名令牌
-	secret, err := loadTokenSecretByUserName(username)
+	secret, err := loadTokenSecretByUserName(claims.Username)
 	if err != nil {
 		return "", err
 	}
-	return token.SignedString(secret)
+	signed, err := token.SignedString(secret)
+	if err != nil || !vars.Config().TokenEncryption.Enabled {
+		return signed, err
+	}
+	return EncryptToken(signed)
 }
 
-// ParseToken 解析JWT令牌
-// 返回用户名、过期时间和错误信息
-func ParseToken(tokenString string) (string, time.Time, error) {
+// ParseToken 解析JWT令牌，支持加密后的 JWE 令牌
+// 返回令牌声明和错误信息
+func ParseToken(tokenString string) (*Claims, error) {
+	// 加密的令牌先解密，未加密的令牌直接校验签名
+	if IsEncryptedToken(tokenString) {
+		decrypted, err := DecryptToken(tokenString)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		tokenString = decrypted
+	}
 	// 解析令牌
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		claims, ok := token.Claims.(*Claims)
 		if !ok {
 			return "", ErrInvalidToken
 		}
-		return loadTokenSecretByUserName(claims.Username)
+		kid, _ := token.Header["kid"].(string)
+		return loadVerificationKeys(claims.Username, kid)
 	})
 
 	if err != nil {
 		// 检查是否是过期错误
 		if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) {
-			return "", time.Time{}, ErrExpiredToken
+			return nil, ErrExpiredToken
 		}
-		return "", time.Time{}, ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
 
 	// 验证令牌
 	if !token.Valid {
-		return "", time.Time{}, ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
 
 	// 获取声明
 	claims, ok := token.Claims.(*Claims)
 	if !ok {
-		return "", time.Time{}, ErrInvalidToken
+		return nil, ErrInvalidToken
 	}
 
-	// 获取过期时间
-	expiresAt, err := claims.GetExpirationTime()
-	if err != nil {
-		return "", time.Time{}, ErrInvalidToken
+	// 必须包含过期时间
+	if claims.ExpiresAt == nil {
+		return nil, ErrInvalidToken
 	}
 
-	return claims.Username, expiresAt.Time, nil
+	return claims, nil
 }
 
 // ValidateToken 验证令牌是否有效
 // 返回是否有效和错误信息
 func ValidateToken(tokenString string) (bool, error) {
-	_, _, err := ParseToken(tokenString)
+	_, err := ParseToken(tokenString)
 	if err != nil {
 		return false, err
 	}
@@ -102,14 +143,127 @@ func ValidateToken(tokenString string) (bool, error) {
 }
 
 func loadTokenSecretByUserName(username string) ([]byte, error) {
-	for _, u := range vars.Config.Users {
-		if u.Username == username {
-			key := make([]byte, 0, len(vars.Config.Secret)+len(u.Nonce)+len(u.Password))
-			key = append(key, vars.Config.Secret...)
-			key = append(key, u.Nonce...)
-			key = append(key, u.Password...)
-			return key, nil
+	u, ok := vars.UserStore.Get(username)
+	if !ok {
+		return nil, fmt.Errorf("用户 %s 不存在", username)
+	}
+	return userTokenKey(vars.Config().Secret, u)
+}
+
+// loadVerificationKeys 按令牌头部的 kid 选择校验密钥，没有 kid 的旧令牌在截止时间之前依次尝试所有可用的密钥
+func loadVerificationKeys(username, kid string) (any, error) {
+	u, ok := vars.UserStore.Get(username)
+	if !ok {
+		return nil, fmt.Errorf("用户 %s 不存在", username)
+	}
+	secrets := ActiveSecrets()
+	if kid == "" {
+		if deadline := legacyTokenDeadline(); deadline.IsZero() || time.Now().After(deadline) {
+			return nil, ErrInvalidToken
+		}
+		var keys jwt.VerificationKeySet
+		for _, secret := range secrets {
+			key, err := userTokenKey(secret, u)
+			if err != nil {
+				return nil, err
+			}
+			keys.Keys = append(keys.Keys, key, legacyUserTokenKey(secret, u))
+		}
+		return keys, nil
+	}
+	for _, secret := range secrets {
+		if SecretKeyID(secret) == kid {
+			return userTokenKey(secret, u)
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+// legacyTokenDeadline 返回没有 kid 的旧令牌的截止时间，优先使用 legacy_token_deadline，其次是最早到期的旧密钥的 expires_at
+// 都没有设置时返回零值，不再接受旧令牌
+func legacyTokenDeadline() time.Time {
+	if deadline := vars.Config().LegacyTokenDeadline; !deadline.IsZero() {
+		return deadline
+	}
+	var deadline time.Time
+	for _, p := range vars.Config().PreviousSecrets {
+		if !p.ExpiresAt.IsZero() && (deadline.IsZero() || p.ExpiresAt.Before(deadline)) {
+			deadline = p.ExpiresAt
+		}
+	}
+	return deadline
+}
+
+// userTokenKey 使用 HKDF-SHA256 从服务端密钥派生用户的签名密钥
+// 用户的 Nonce 作为盐，修改密码、强制退出时更换 Nonce 使已签发的令牌失效，密码不参与密钥派生
+// 在外部修改的密码通过密码指纹发现，见 CheckPasswordFingerprints
+func userTokenKey(secret string, u vars.UserItem) ([]byte, error) {
+	return hkdf.Key(sha256.New, []byte(secret), []byte(u.Nonce), "arkauthn token signing key "+u.Username, 32)
+}
+
+// legacyUserTokenKey 早期版本直接拼接密钥、Nonce 和密码作为签名密钥，只用于校验升级前签发的没有 kid 的令牌
+func legacyUserTokenKey(secret string, u vars.UserItem) []byte {
+	key := make([]byte, 0, len(secret)+len(u.Nonce)+len(u.Password))
+	key = append(key, secret...)
+	key = append(key, u.Nonce...)
+	key = append(key, u.Password...)
+	return key
+}
+
+// CheckSigningKeys 检查当前密钥和宽限期内的旧密钥能否派生签名密钥并完成签名校验，用于就绪检查
+// 过期的旧密钥不再使用，不参与检查；与当前密钥相同的旧密钥会导致 kid 冲突
+func CheckSigningKeys() error {
+	if vars.Config().Secret == "" {
+		return errors.New("secret is empty")
+	}
+	currentKID := SecretKeyID(vars.Config().Secret)
+	now := time.Now()
+	for i, p := range vars.Config().PreviousSecrets {
+		if !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt) {
+			continue
+		}
+		if p.Secret == "" {
+			return fmt.Errorf("previous_secrets[%d] is empty", i)
+		}
+		if SecretKeyID(p.Secret) == currentKID {
+			return fmt.Errorf("previous_secrets[%d] is the same as secret", i)
+		}
+	}
+	probe := vars.UserItem{Username: "readiness-probe", Nonce: "readiness-probe"}
+	for _, secret := range ActiveSecrets() {
+		key, err := userTokenKey(secret, probe)
+		if err != nil {
+			return err
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: probe.Username}).SignedString(key)
+		if err != nil {
+			return err
+		}
+		if _, err := jwt.Parse(signed, func(*jwt.Token) (any, error) { return key, nil }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name})); err != nil {
+			return fmt.Errorf("verify key %s: %w", SecretKeyID(secret), err)
+		}
+	}
+	return nil
+}
+
+// SecretKeyID 返回密钥的 kid，为密钥 SHA-256 摘要的前 8 字节
+func SecretKeyID(secret string) string {
+	return hex.EncodeToString(SHA256([]byte(secret))[:8])
+}
+
+// ActiveSecrets 返回当前密钥和仍在宽限期内的旧密钥，当前密钥排在第一个
+func ActiveSecrets() []string {
+	return ConfigActiveSecrets(vars.Config())
+}
+
+// ConfigActiveSecrets 与 ActiveSecrets 相同，用于尚未发布的配置
+func ConfigActiveSecrets(conf *vars.ConfigFile) []string {
+	secrets := []string{conf.Secret}
+	now := time.Now()
+	for _, p := range conf.PreviousSecrets {
+		if p.Secret != "" && (p.ExpiresAt.IsZero() || now.Before(p.ExpiresAt)) {
+			secrets = append(secrets, p.Secret)
 		}
 	}
-	return nil, fmt.Errorf("用户 %s 不存在", username)
+	return secrets
 }
@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const testSecret = "test-secret-test-secret-test-secret"
+
+// setupTokenConfig 使用测试配置，测试结束后恢复原有的全局状态
+func setupTokenConfig(t *testing.T, conf vars.ConfigFile) {
+	t.Helper()
+	oldConfig, oldUserStore := *vars.Config(), vars.UserStore
+	t.Cleanup(func() {
+		vars.SetConfig(oldConfig)
+		vars.UserStore = oldUserStore
+	})
+	if conf.Secret == "" {
+		conf.Secret = testSecret
+	}
+	if conf.Users == nil {
+		conf.Users = []vars.UserItem{{Username: "alice", Password: "alicepass", Nonce: "n1"}}
+	}
+	vars.SetConfig(conf)
+	vars.UserStore = NewConfigUserStore()
+}
+
+// legacyToken 按早期版本的方式签发没有 kid 的令牌
+func legacyToken(t *testing.T, secret string) string {
+	t.Helper()
+	u, _ := vars.UserStore.Get("alice")
+	now := time.Now()
+	claims := Claims{
+		Username: "alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(legacyUserTokenKey(secret, u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestLegacyTokenDeadline(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		deadline time.Time
+		previous []vars.PreviousSecret
+		wantErr  error
+	}{
+		{"no deadline", time.Time{}, nil, ErrInvalidToken},
+		{"before deadline", future, nil, nil},
+		{"after deadline", past, nil, ErrInvalidToken},
+		{"previous secret not expired", time.Time{}, []vars.PreviousSecret{{Secret: "old", ExpiresAt: future}}, nil},
+		{"first previous secret expired", time.Time{}, []vars.PreviousSecret{{Secret: "old", ExpiresAt: future}, {Secret: "older", ExpiresAt: past}}, ErrInvalidToken},
+		{"previous secret without expiry", time.Time{}, []vars.PreviousSecret{{Secret: "old"}}, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTokenConfig(t, vars.ConfigFile{LegacyTokenDeadline: tt.deadline, PreviousSecrets: tt.previous})
+			_, err := ParseToken(legacyToken(t, testSecret))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamperSegment 修改令牌第 i 段解码后的第一个字节
+func tamperSegment(t *testing.T, token string, i int) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	data, err := base64.RawURLEncoding.DecodeString(parts[i])
+	if err != nil || len(data) == 0 {
+		t.Fatalf("decode segment %d: %v", i, err)
+	}
+	data[0] ^= 0x01
+	parts[i] = base64.RawURLEncoding.EncodeToString(data)
+	return strings.Join(parts, ".")
+}
+
+func TestEncryptedToken(t *testing.T) {
+	setupTokenConfig(t, vars.ConfigFile{TokenEncryption: vars.TokenEncryption{Enabled: true}})
+	token, err := GenerateToken("alice", "s1", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedToken(token) {
+		t.Fatalf("token %q is not a JWE", token)
+	}
+	if strings.Contains(token, "alice") || strings.Contains(token, base64.RawURLEncoding.EncodeToString([]byte(`"user":"alice"`))) {
+		t.Error("encrypted token exposes the username")
+	}
+	tests := []struct {
+		name    string
+		token   string
+		conf    func(conf *vars.ConfigFile)
+		wantErr error
+	}{
+		{name: "round trip", token: token},
+		{name: "tampered header", token: tamperSegment(t, token, 0), wantErr: ErrInvalidToken},
+		{name: "tampered iv", token: tamperSegment(t, token, 2), wantErr: ErrInvalidToken},
+		{name: "tampered ciphertext", token: tamperSegment(t, token, 3), wantErr: ErrInvalidToken},
+		{name: "tampered tag", token: tamperSegment(t, token, 4), wantErr: ErrInvalidToken},
+		{name: "encrypted key not empty", token: strings.Replace(token, "..", ".AAAA.", 1), wantErr: ErrInvalidToken},
+		{name: "truncated", token: token[:strings.LastIndex(token, ".")], wantErr: ErrInvalidToken},
+		{
+			name:    "different encryption key",
+			token:   token,
+			conf:    func(conf *vars.ConfigFile) { conf.TokenEncryption.Key = "another-encryption-key" },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:  "encryption disabled",
+			token: token,
+			conf:  func(conf *vars.ConfigFile) { conf.TokenEncryption.Enabled = false },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.conf != nil {
+				conf := *vars.Config()
+				tt.conf(&conf)
+				setupTokenConfig(t, conf)
+			}
+			claims, err := ParseToken(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (claims.Username != "alice" || claims.ID != "s1") {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	const oldSecret = "old-secret-old-secret-old-secret"
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		previous []vars.PreviousSecret
+		encrypt  bool
+		wantErr  error
+	}{
+		{"previous secret in grace period", []vars.PreviousSecret{{Secret: oldSecret, ExpiresAt: future}}, false, nil},
+		{"previous secret without expiry", []vars.PreviousSecret{{Secret: oldSecret}}, false, nil},
+		{"previous secret expired", []vars.PreviousSecret{{Secret: oldSecret, ExpiresAt: past}}, false, ErrInvalidToken},
+		{"previous secret removed", nil, false, ErrInvalidToken},
+		{"encrypted with previous secret", []vars.PreviousSecret{{Secret: oldSecret, ExpiresAt: future}}, true, nil},
+		{"encrypted with expired secret", []vars.PreviousSecret{{Secret: oldSecret, ExpiresAt: past}}, true, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryption := vars.TokenEncryption{Enabled: tt.encrypt}
+			setupTokenConfig(t, vars.ConfigFile{Secret: oldSecret, TokenEncryption: encryption})
+			token, err := GenerateToken("alice", "s1", time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setupTokenConfig(t, vars.ConfigFile{PreviousSecrets: tt.previous, TokenEncryption: encryption})
+			if _, err := ParseToken(token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenKeyID(t *testing.T) {
+	setupTokenConfig(t, vars.ConfigFile{PreviousSecrets: []vars.PreviousSecret{{Secret: "old-secret"}}})
+	u, _ := vars.UserStore.Get("alice")
+	sign := func(kid, secret string) string {
+		t.Helper()
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+			Username:         "alice",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		})
+		token.Header["kid"] = kid
+		key, err := userTokenKey(secret, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"current kid", sign(SecretKeyID(testSecret), testSecret), nil},
+		{"previous kid", sign(SecretKeyID("old-secret"), "old-secret"), nil},
+		{"unknown kid", sign("0123456789abcdef", testSecret), ErrInvalidToken},
+		{"kid of another secret", sign(SecretKeyID("old-secret"), testSecret), ErrInvalidToken},
+		{"unknown secret", sign(SecretKeyID("unknown"), "unknown"), ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseToken(tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenRevokedByUserChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(u *vars.UserItem)
+		wantErr error
+	}{
+		{"unchanged", func(u *vars.UserItem) {}, nil},
+		{"nonce rotated", func(u *vars.UserItem) { u.Nonce = "n2" }, ErrInvalidToken},
+		{"password changed externally", func(u *vars.UserItem) { u.Password = "newpass" }, ErrInvalidToken},
+		{"admin flag changed", func(u *vars.UserItem) { u.Admin = true }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTokenConfig(t, vars.ConfigFile{})
+			conf := *vars.Config()
+			conf.Users = slices.Clone(conf.Users)
+			CheckPasswordFingerprints(ActiveSecrets(), conf.Users)
+			vars.SetConfig(conf)
+			token, err := GenerateToken("alice", "s1", time.Hour, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 与重新加载配置相同：密码与指纹不符时更换 nonce
+			conf.Users = slices.Clone(conf.Users)
+			tt.change(&conf.Users[0])
+			CheckPasswordFingerprints(ActiveSecrets(), conf.Users)
+			vars.SetConfig(conf)
+			if _, err := ParseToken(token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordFingerprints(t *testing.T) {
+	const secret, previous = "current-secret", "previous-secret"
+	tests := []struct {
+		name        string
+		fingerprint string
+		wantRotated bool
+		wantUpdated bool
+	}{
+		{"current", PasswordFingerprint(secret, "hash"), false, false},
+		{"missing", "", false, true},
+		{"previous secret", PasswordFingerprint(previous, "hash"), false, true},
+		{"password changed", PasswordFingerprint(secret, "old-hash"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := []vars.UserItem{{Username: "alice", Password: "hash", Nonce: "n1", PasswordFingerprint: tt.fingerprint}}
+			rotated, updated := CheckPasswordFingerprints([]string{secret, previous}, users)
+			if (len(rotated) > 0) != tt.wantRotated || updated != tt.wantUpdated {
+				t.Errorf("CheckPasswordFingerprints() = %v, %v, want rotated %v updated %v", rotated, updated, tt.wantRotated, tt.wantUpdated)
+			}
+			if (users[0].Nonce != "n1") != tt.wantRotated {
+				t.Errorf("nonce = %q, rotated %v", users[0].Nonce, tt.wantRotated)
+			}
+			if users[0].PasswordFingerprint != PasswordFingerprint(secret, "hash") {
+				t.Error("fingerprint not updated to the current secret")
+			}
+		})
+	}
+}
+
+func TestCheckSigningKeys(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		secret   string
+		previous []vars.PreviousSecret
+		wantErr  bool
+	}{
+		{"current secret", testSecret, nil, false},
+		{"empty secret", "", nil, true},
+		{"previous secret in grace period", testSecret, []vars.PreviousSecret{{Secret: "old", ExpiresAt: future}}, false},
+		{"previous secret without expiry", testSecret, []vars.PreviousSecret{{Secret: "old"}}, false},
+		{"empty previous secret", testSecret, []vars.PreviousSecret{{ExpiresAt: future}}, true},
+		{"previous secret same as current", testSecret, []vars.PreviousSecret{{Secret: testSecret, ExpiresAt: future}}, true},
+		{"expired previous secret ignored", testSecret, []vars.PreviousSecret{{ExpiresAt: past}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTokenConfig(t, vars.ConfigFile{PreviousSecrets: tt.previous})
+			conf := *vars.Config()
+			conf.Secret = tt.secret
+			vars.SetConfig(conf)
+			if err := CheckSigningKeys(); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSigningKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,583 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	UserFileHtpasswd = "htpasswd"
+	UserFileYAML     = "yaml"
+	UserFileJSON     = "json"
+	UserFileCSV      = "csv"
+)
+
+// userFileCheckInterval 检查用户文件是否被外部修改的间隔
+const userFileCheckInterval = 2 * time.Second
+
+// ConfigUserStore 使用配置文件中的 users
+type ConfigUserStore struct{}
+
+func NewConfigUserStore() *ConfigUserStore {
+	return &ConfigUserStore{}
+}
+
+func (ConfigUserStore) Get(username string) (vars.UserItem, bool) {
+	return findUserItem(vars.Config().Users, username)
+}
+
+func (ConfigUserStore) List() []vars.UserItem {
+	return slices.Clone(vars.Config().Users)
+}
+
+// Update 在配置锁内修改用户列表并保存到配置文件，保存失败时回滚
+func (ConfigUserStore) Update(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	vars.ConfigMu.Lock()
+	defer vars.ConfigMu.Unlock()
+	conf := *vars.Config()
+	users, err := fn(slices.Clone(conf.Users))
+	if err != nil {
+		return err
+	}
+	setChangedPasswordFingerprints(conf.Secret, conf.Users, users)
+	// 删除用户后后面的用户位置会变化，按用户名更新从文件或环境变量读取的密码对应的字段路径
+	oldIndex := make([]int, len(users))
+	for i, u := range users {
+		oldIndex[i] = slices.IndexFunc(conf.Users, func(o vars.UserItem) bool { return o.Username == u.Username })
+	}
+	conf.Users = users
+	conf.SecretRefs = RemapSecretRefs(conf.SecretRefs, "users", "password", oldIndex)
+	return SaveConfig(conf)
+}
+
+// ErrUserFileReadOnly htpasswd 用户文件未允许写回
+var ErrUserFileReadOnly = errors.New("user file is read-only")
+
+// ErrHtpasswdUserAttributes htpasswd 不能保存管理员标记和用户组
+var ErrHtpasswdUserAttributes = errors.New("htpasswd cannot store admin flag or groups")
+
+// FileUserStore 从外部用户文件读取用户，文件被修改后自动重新加载
+// htpasswd 只保存用户名和密码，管理员通过 admins 指定，nonce 和密码指纹保存在 state_file 中
+type FileUserStore struct {
+	path      string
+	format    string
+	admins    []string
+	writable  bool
+	stateFile string
+
+	mu        sync.RWMutex
+	users     []vars.UserItem
+	states    map[string]htpasswdUserState
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+}
+
+func NewFileUserStore(conf vars.UserFile) (*FileUserStore, error) {
+	format := strings.ToLower(conf.Format)
+	if format == "" {
+		format = userFileFormatByExt(conf.Path)
+	}
+	switch format {
+	case UserFileHtpasswd, UserFileYAML, UserFileJSON, UserFileCSV:
+	default:
+		return nil, fmt.Errorf("unsupported user file format %q", format)
+	}
+	s := &FileUserStore{
+		path:      conf.Path,
+		format:    format,
+		admins:    conf.Admins,
+		writable:  conf.Writable || format != UserFileHtpasswd,
+		stateFile: conf.StateFile,
+		states:    make(map[string]htpasswdUserState),
+	}
+	if format == UserFileHtpasswd {
+		if s.stateFile == "" {
+			logrus.Warnf("user_file.state_file is not configured, force logout of htpasswd users is lost on restart")
+		} else if err := s.loadState(); err != nil {
+			return nil, err
+		}
+	}
+	updated, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	// 服务停止期间修改的密码在首次加载时发现，把更换的 Nonce 和指纹写回文件，htpasswd 在加载时已写入 state_file
+	if updated && s.format != UserFileHtpasswd {
+		if err := s.Update(func(users []vars.UserItem) ([]vars.UserItem, error) { return users, nil }); err != nil {
+			logrus.Errorf("Save user file failed: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// htpasswdUserState state_file 中保存的 htpasswd 用户状态
+type htpasswdUserState struct {
+	Nonce               string `json:"nonce"`
+	PasswordFingerprint string `json:"password_fingerprint,omitempty"`
+}
+
+// ReadOnly htpasswd 文件未设置 writable 时只读
+func (s *FileUserStore) ReadOnly() bool {
+	return !s.writable
+}
+
+// PasswordHashAlgorithm htpasswd 需要能被 Nginx、Apache 识别，写入的密码固定使用 bcrypt
+func (s *FileUserStore) PasswordHashAlgorithm() string {
+	if s.format == UserFileHtpasswd {
+		return PasswordHashBcrypt
+	}
+	return ""
+}
+
+// RequireHashedPasswords 用户文件可能由其他工具生成，无法识别的格式不按明文比较
+func (s *FileUserStore) RequireHashedPasswords() bool {
+	return true
+}
+
+func userFileFormatByExt(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return UserFileYAML
+	case ".json":
+		return UserFileJSON
+	case ".csv":
+		return UserFileCSV
+	}
+	return UserFileHtpasswd
+}
+
+func (s *FileUserStore) Get(username string) (vars.UserItem, bool) {
+	s.reloadIfChanged()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := findUserItem(s.users, username)
+	if ok && slices.Contains(s.admins, username) {
+		u.Admin = true
+	}
+	return u, ok
+}
+
+func (s *FileUserStore) List() []vars.UserItem {
+	s.reloadIfChanged()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := slices.Clone(s.users)
+	for i := range users {
+		if slices.Contains(s.admins, users[i].Username) {
+			users[i].Admin = true
+		}
+	}
+	return users
+}
+
+// Update 修改用户并写回用户文件，写入前先合并文件的外部修改
+func (s *FileUserStore) Update(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	s.reloadIfChanged()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.format == UserFileHtpasswd {
+		return s.updateHtpasswd(fn)
+	}
+	users, err := fn(slices.Clone(s.users))
+	if err != nil {
+		return err
+	}
+	setChangedPasswordFingerprints(vars.Config().Secret, s.users, users)
+	data, err := s.encode(users)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	s.users = users
+	if st, err := os.Stat(s.path); err == nil {
+		s.modTime, s.size = st.ModTime(), st.Size()
+	}
+	return nil
+}
+
+// updateHtpasswd 只有添加、删除用户或修改密码时才写回 htpasswd 文件，更换的 nonce 和密码指纹只写入 state_file
+// 调用方需持有写锁
+func (s *FileUserStore) updateHtpasswd(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	current := slices.Clone(s.users)
+	for i := range current {
+		current[i].Admin = slices.Contains(s.admins, current[i].Username)
+	}
+	users, err := fn(current)
+	if err != nil {
+		return err
+	}
+	setChangedPasswordFingerprints(vars.Config().Secret, s.users, users)
+	fileChanged := len(users) != len(s.users)
+	for i, u := range users {
+		old, ok := findUserItem(s.users, u.Username)
+		if u.Admin != slices.Contains(s.admins, u.Username) || len(u.Groups) > 0 {
+			return ErrHtpasswdUserAttributes
+		}
+		if !ok || old.Password != u.Password {
+			fileChanged = true
+		}
+		users[i].Admin = false
+	}
+	if fileChanged {
+		if !s.writable {
+			return ErrUserFileReadOnly
+		}
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return err
+		}
+		data, err = rewriteHtpasswd(data, users)
+		if err != nil {
+			return err
+		}
+		if err := WriteFileAtomic(s.path, data, 0600); err != nil {
+			return err
+		}
+		if st, err := os.Stat(s.path); err == nil {
+			s.modTime, s.size = st.ModTime(), st.Size()
+		}
+	}
+	old := s.states
+	s.states = make(map[string]htpasswdUserState, len(users))
+	for _, u := range users {
+		s.states[u.Username] = htpasswdUserState{Nonce: u.Nonce, PasswordFingerprint: u.PasswordFingerprint}
+	}
+	if err := s.saveState(); err != nil {
+		s.states = old
+		return err
+	}
+	s.users = users
+	return nil
+}
+
+// loadState 从 state_file 读取 htpasswd 用户的 nonce 和密码指纹，文件不存在时忽略
+// 早期版本只保存 nonce 字符串，读取后按没有指纹处理
+func (s *FileUserStore) loadState() error {
+	data, err := os.ReadFile(s.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for username, item := range raw {
+		var state htpasswdUserState
+		if err := json.Unmarshal(item, &state.Nonce); err != nil {
+			if err := json.Unmarshal(item, &state); err != nil {
+				return fmt.Errorf("parse %s: %w", s.stateFile, err)
+			}
+		}
+		s.states[username] = state
+	}
+	return nil
+}
+
+// saveState 将 htpasswd 用户的 nonce 和密码指纹写入 state_file，调用方需持有写锁
+func (s *FileUserStore) saveState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.stateFile, data, 0600)
+}
+
+func (s *FileUserStore) reloadIfChanged() {
+	s.mu.Lock()
+	needCheck := time.Since(s.checkedAt) > userFileCheckInterval
+	if needCheck {
+		s.checkedAt = time.Now()
+	}
+	modTime, size := s.modTime, s.size
+	s.mu.Unlock()
+	if !needCheck {
+		return
+	}
+	st, err := os.Stat(s.path)
+	if err != nil || (st.ModTime().Equal(modTime) && st.Size() == size) {
+		return
+	}
+	updated, err := s.load()
+	if err != nil {
+		// 文件可能还未写完，继续使用旧数据
+		logrus.Errorf("Reload user file failed: %v", err)
+		return
+	}
+	logrus.Infoln("User file reloaded from", s.path)
+	// 外部修改的密码和更换的 Nonce 立即生效，不等待认证结果缓存过期
+	if vars.AuthCache != nil {
+		vars.AuthCache.Clear()
+	}
+	// htpasswd 的 Nonce 在加载时已写入 state_file，其他格式把更换的 Nonce 和指纹写回文件，避免重新加载后恢复
+	if updated && s.format != UserFileHtpasswd {
+		if err := s.Update(func(users []vars.UserItem) ([]vars.UserItem, error) { return users, nil }); err != nil {
+			logrus.Errorf("Save user file failed: %v", err)
+		}
+	}
+}
+
+// load 读取用户文件并检查密码指纹，返回是否更换了 Nonce 或更新了指纹
+func (s *FileUserStore) load() (bool, error) {
+	st, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	users, err := s.decode(data)
+	if err != nil {
+		return false, fmt.Errorf("parse user file %s: %w", s.path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.format == UserFileHtpasswd {
+		for i := range users {
+			state := s.states[users[i].Username]
+			users[i].Nonce, users[i].PasswordFingerprint = state.Nonce, state.PasswordFingerprint
+		}
+	}
+	for _, u := range users {
+		if !IsPasswordHash(u.Password) {
+			logrus.Warnf("Password of %s in user file is not a supported hash and cannot be used to log in, prefix plaintext passwords with {PLAIN}", u.Username)
+		}
+	}
+	rotated, updated := CheckPasswordFingerprints(ActiveSecrets(), users)
+	for _, username := range rotated {
+		logrus.Infof("Password of %s changed in user file, issued tokens are revoked", username)
+	}
+	if updated && s.format == UserFileHtpasswd {
+		for _, u := range users {
+			s.states[u.Username] = htpasswdUserState{Nonce: u.Nonce, PasswordFingerprint: u.PasswordFingerprint}
+		}
+		if err := s.saveState(); err != nil {
+			logrus.Errorf("Save user file state failed: %v", err)
+		}
+	}
+	s.users = users
+	s.modTime, s.size = st.ModTime(), st.Size()
+	return updated, nil
+}
+
+func (s *FileUserStore) decode(data []byte) ([]vars.UserItem, error) {
+	switch s.format {
+	case UserFileHtpasswd:
+		return parseHtpasswd(data)
+	case UserFileCSV:
+		return parseUserCSV(data)
+	case UserFileJSON:
+		var f struct {
+			Users []vars.UserItem `json:"users"`
+		}
+		err := json.Unmarshal(data, &f)
+		return f.Users, err
+	case UserFileYAML:
+		var f struct {
+			Users []vars.UserItem `yaml:"users"`
+		}
+		err := yaml.Unmarshal(data, &f)
+		return f.Users, err
+	}
+	return nil, errors.New("unsupported user file format")
+}
+
+func (s *FileUserStore) encode(users []vars.UserItem) ([]byte, error) {
+	switch s.format {
+	case UserFileCSV:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"username", "password", "admin", "nonce", "groups", "password_fingerprint"})
+		for _, u := range users {
+			w.Write([]string{u.Username, u.Password, strconv.FormatBool(u.Admin), u.Nonce, strings.Join(u.Groups, " "), u.PasswordFingerprint})
+		}
+		w.Flush()
+		return buf.Bytes(), w.Error()
+	case UserFileJSON:
+		return json.MarshalIndent(map[string][]vars.UserItem{"users": users}, "", "    ")
+	case UserFileYAML:
+		return yaml.Marshal(map[string][]vars.UserItem{"users": users})
+	}
+	return nil, errors.New("unsupported user file format")
+}
+
+// parseHtpasswd 解析 Apache htpasswd 文件，每行 user:hash，忽略空行和 # 开头的注释
+func parseHtpasswd(data []byte) ([]vars.UserItem, error) {
+	var users []vars.UserItem
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: invalid htpasswd entry", n)
+		}
+		users = append(users, vars.UserItem{Username: username, Password: password})
+	}
+	return users, scanner.Err()
+}
+
+// rewriteHtpasswd 按新的用户列表修改 htpasswd 文件内容，保留注释、空行和原有顺序，新用户添加到末尾
+func rewriteHtpasswd(data []byte, users []vars.UserItem) ([]byte, error) {
+	pending := make(map[string]vars.UserItem, len(users))
+	for _, u := range users {
+		if u.Username == "" || strings.ContainsAny(u.Username, ":\n") || strings.Contains(u.Password, "\n") {
+			return nil, fmt.Errorf("invalid htpasswd entry for %q", u.Username)
+		}
+		pending[u.Username] = u
+	}
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			username, _, _ := strings.Cut(trimmed, ":")
+			u, ok := pending[username]
+			if !ok { // 已删除的用户
+				continue
+			}
+			delete(pending, username)
+			line = u.Username + ":" + u.Password
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if _, ok := pending[u.Username]; ok {
+			buf.WriteString(u.Username + ":" + u.Password + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// parseUserCSV 解析 username,password[,admin[,nonce[,groups[,password_fingerprint]]]] 格式的 CSV，第一行为 username 时视为表头
+// groups 为空格分隔的用户组
+func parseUserCSV(data []byte) ([]vars.UserItem, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	var users []vars.UserItem
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && strings.EqualFold(record[0], "username") {
+			continue
+		}
+		if len(record) < 2 || record[0] == "" {
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("line %d: username and password are required", line)
+		}
+		u := vars.UserItem{Username: record[0], Password: record[1]}
+		if len(record) > 2 && record[2] != "" {
+			if u.Admin, err = strconv.ParseBool(record[2]); err != nil {
+				line, _ := r.FieldPos(2)
+				return nil, fmt.Errorf("line %d: invalid admin value %q", line, record[2])
+			}
+		}
+		if len(record) > 3 {
+			u.Nonce = record[3]
+		}
+		if len(record) > 4 {
+			u.Groups = strings.Fields(record[4])
+		}
+		if len(record) > 5 {
+			u.PasswordFingerprint = record[5]
+		}
+		users = append(users, u)
+	}
+}
+
+// PasswordFingerprint 返回密码（哈希）的指纹 HMAC-SHA256(secret, password)，与 Nonce 一起保存
+// 不保存密码本身的摘要，避免明文密码可以通过指纹离线猜测
+func PasswordFingerprint(secret, password string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// CheckPasswordFingerprints 在加载用户时检查密码指纹，secrets 为 ActiveSecrets 返回的密钥
+// 指纹与密码不符说明密码在外部被修改过（包括服务停止期间），更换 Nonce 使已签发的令牌失效
+// 没有指纹（升级前创建的用户）或指纹由宽限期内的旧密钥计算时只更新指纹
+// 直接修改 users，返回更换了 Nonce 的用户名，以及是否有需要写回的修改
+func CheckPasswordFingerprints(secrets []string, users []vars.UserItem) ([]string, bool) {
+	var rotated []string
+	updated := false
+	for i := range users {
+		u := &users[i]
+		current := PasswordFingerprint(secrets[0], u.Password)
+		if u.PasswordFingerprint == current {
+			continue
+		}
+		updated = true
+		known := u.PasswordFingerprint == ""
+		for _, secret := range secrets[1:] {
+			if u.PasswordFingerprint == PasswordFingerprint(secret, u.Password) {
+				known = true
+			}
+		}
+		u.PasswordFingerprint = current
+		if !known {
+			u.Nonce = RandString(16)
+			rotated = append(rotated, u.Username)
+		}
+	}
+	return rotated, updated
+}
+
+// setChangedPasswordFingerprints 用户存储的 Update 中为新建或修改了密码的用户更新指纹，Nonce 由调用方负责更换
+// 未修改密码的用户保留原有指纹，外部修改的密码在下次加载时仍能发现
+func setChangedPasswordFingerprints(secret string, oldUsers, users []vars.UserItem) {
+	for i := range users {
+		if old, ok := findUserItem(oldUsers, users[i].Username); !ok || old.Password != users[i].Password {
+			users[i].PasswordFingerprint = PasswordFingerprint(secret, users[i].Password)
+		}
+	}
+}
+
+func findUserItem(users []vars.UserItem, username string) (vars.UserItem, bool) {
+	for _, u := range users {
+		if u.Username == username {
+			return u, true
+		}
+	}
+	return vars.UserItem{}, false
+}
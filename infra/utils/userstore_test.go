@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const testHtpasswd = `# shared with nginx
+alice:$2y$05$abcdefghijklmnopqrstuu5Ud0QmF3Bq5vE7Tq0Xy3p9a0b1c2d3e
+
+bob:{PLAIN}secret
+`
+
+func newTestHtpasswdStore(t *testing.T, writable bool) (*FileUserStore, vars.UserFile) {
+	t.Helper()
+	dir := t.TempDir()
+	conf := vars.UserFile{
+		Path:      filepath.Join(dir, ".htpasswd"),
+		Admins:    []string{"alice"},
+		Writable:  writable,
+		StateFile: filepath.Join(dir, "nonces.json"),
+	}
+	if err := os.WriteFile(conf.Path, []byte(testHtpasswd), 0640); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileUserStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conf
+}
+
+func setNonce(username, nonce string) func([]vars.UserItem) ([]vars.UserItem, error) {
+	return func(users []vars.UserItem) ([]vars.UserItem, error) {
+		users[findUserIndex(users, username)].Nonce = nonce
+		return users, nil
+	}
+}
+
+func findUserIndex(users []vars.UserItem, username string) int {
+	for i, u := range users {
+		if u.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestHtpasswdUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		writable bool
+		fn       func([]vars.UserItem) ([]vars.UserItem, error)
+		wantErr  error
+		wantFile string
+	}{
+		{
+			name:     "force logout on read-only file",
+			fn:       setNonce("bob", "n2"),
+			wantFile: testHtpasswd,
+		},
+		{
+			name: "add user on read-only file",
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				return append(users, vars.UserItem{Username: "carol", Password: "x"}), nil
+			},
+			wantErr:  ErrUserFileReadOnly,
+			wantFile: testHtpasswd,
+		},
+		{
+			name:     "keep admin from admins",
+			fn:       func(users []vars.UserItem) ([]vars.UserItem, error) { return users, nil },
+			wantFile: testHtpasswd,
+		},
+		{
+			name: "grant admin",
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				users[findUserIndex(users, "bob")].Admin = true
+				return users, nil
+			},
+			wantErr:  ErrHtpasswdUserAttributes,
+			wantFile: testHtpasswd,
+		},
+		{
+			name:     "change password keeps comments",
+			writable: true,
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				users[findUserIndex(users, "bob")].Password = "$2y$10$new"
+				return append(users, vars.UserItem{Username: "carol", Password: "$2y$10$carol"}), nil
+			},
+			wantFile: strings.Replace(testHtpasswd, "bob:{PLAIN}secret", "bob:$2y$10$new", 1) + "carol:$2y$10$carol\n",
+		},
+		{
+			name:     "delete user",
+			writable: true,
+			fn: func(users []vars.UserItem) ([]vars.UserItem, error) {
+				return users[findUserIndex(users, "bob"):], nil
+			},
+			wantFile: "# shared with nginx\n\nbob:{PLAIN}secret\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, conf := newTestHtpasswdStore(t, tt.writable)
+			if err := s.Update(tt.fn); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Update() error = %v, want %v", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(conf.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantFile {
+				t.Errorf("file =\n%s\nwant\n%s", data, tt.wantFile)
+			}
+			if st, _ := os.Stat(conf.Path); st.Mode().Perm() != 0640 {
+				t.Errorf("file mode = %v, want 0640", st.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestHtpasswdNoncePersisted(t *testing.T) {
+	s, conf := newTestHtpasswdStore(t, false)
+	if err := s.Update(setNonce("bob", "n2")); err != nil {
+		t.Fatal(err)
+	}
+	// 重启后强制下线依然有效
+	restarted, err := NewFileUserStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := restarted.Get("bob"); u.Nonce != "n2" {
+		t.Errorf("nonce after restart = %q, want %q", u.Nonce, "n2")
+	}
+	if u, _ := restarted.Get("alice"); !u.Admin {
+		t.Error("alice lost admin flag")
+	}
+}
+
+// 服务停止期间修改的密码在启动时通过密码指纹发现
+func TestUserFilePasswordChangedWhileStopped(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+	}{
+		{"htpasswd", ".htpasswd", testHtpasswd},
+		{"yaml", "users.yaml", "users:\n  - username: bob\n    password: '{PLAIN}secret'\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := vars.UserFile{Path: writeTempFile(t, tt.file, tt.content)}
+			conf.StateFile = filepath.Join(filepath.Dir(conf.Path), "state.json")
+			start := func() vars.UserItem {
+				t.Helper()
+				s, err := NewFileUserStore(conf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				u, _ := s.Get("bob")
+				return u
+			}
+			first := start()
+			if first.PasswordFingerprint == "" {
+				t.Fatal("password fingerprint not recorded on first load")
+			}
+			if second := start(); second.Nonce != first.Nonce {
+				t.Errorf("nonce rotated without password change: %q -> %q", first.Nonce, second.Nonce)
+			}
+			// 只修改密码，保留写回的 nonce 和指纹
+			data, err := os.ReadFile(conf.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = []byte(strings.Replace(string(data), "{PLAIN}secret", "{PLAIN}changed", 1))
+			if err := os.WriteFile(conf.Path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			changed := start()
+			if changed.Nonce == first.Nonce {
+				t.Error("nonce not rotated after password changed while stopped")
+			}
+			// 更换的 Nonce 已写回，再次启动不会重复更换
+			if again := start(); again.Nonce != changed.Nonce {
+				t.Errorf("nonce after restart = %q, want %q", again.Nonce, changed.Nonce)
+			}
+		})
+	}
+}
+
+// 早期版本的 state_file 只保存 nonce 字符串
+func TestHtpasswdLegacyState(t *testing.T) {
+	dir := t.TempDir()
+	conf := vars.UserFile{Path: filepath.Join(dir, ".htpasswd"), StateFile: filepath.Join(dir, "state.json")}
+	if err := os.WriteFile(conf.Path, []byte(testHtpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf.StateFile, []byte(`{"bob":"n2"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileUserStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.Get("bob"); u.Nonce != "n2" || u.PasswordFingerprint == "" {
+		t.Errorf("bob = nonce %q fingerprint %q, want nonce n2 with fingerprint", u.Nonce, u.PasswordFingerprint)
+	}
+}
+
+func TestHtpasswdPasswordAlgorithm(t *testing.T) {
+	s, _ := newTestHtpasswdStore(t, true)
+	if got := s.PasswordHashAlgorithm(); got != PasswordHashBcrypt {
+		t.Errorf("PasswordHashAlgorithm() = %q, want %q", got, PasswordHashBcrypt)
+	}
+	if s.ReadOnly() {
+		t.Error("writable htpasswd is read-only")
+	}
+	jsonStore, err := NewFileUserStore(vars.UserFile{Path: writeTempFile(t, "users.json", `{"users":[]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonStore.ReadOnly() || jsonStore.PasswordHashAlgorithm() != "" {
+		t.Error("json user file should be writable with the configured algorithm")
+	}
+	if !s.RequireHashedPasswords() || !jsonStore.RequireHashedPasswords() {
+		t.Error("user files should not compare unrecognised hashes as plaintext")
+	}
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -1,25 +1,218 @@
 package vars
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type ConfigFile struct {
-	Listen         string     `json:"listen"`
-	Redirect       string     `json:"redirect"`
-	LogFile        string     `json:"log_file,omitempty"`
-	LogLevel       string     `json:"log_level"`
-	Secret         string     `json:"secret"`
-	Users          []UserItem `json:"users"`
-	Jail           JailConfig `json:"jail,omitempty"`
-	TrustedDomains []string   `json:"trusted_domains,omitempty"`
-	TrustedProxies []string   `json:"trusted_proxies,omitempty"`
+	Listen          string           `json:"listen"`
+	ListenMode      string           `json:"listen_mode,omitempty"`
+	Redirect        string           `json:"redirect"`
+	LogFile         string           `json:"log_file,omitempty"`
+	LogLevel        string           `json:"log_level"`
+	Secret          string           `json:"secret"`
+	SecretFile      string           `json:"secret_file,omitempty"`
+	PreviousSecrets []PreviousSecret `json:"previous_secrets,omitempty"` // 轮换前的密钥，宽限期内仍可校验旧令牌
+	Users           []UserItem       `json:"users"`
+	Jail            JailConfig       `json:"jail,omitempty"`
+	TrustedDomains  []string         `json:"trusted_domains,omitempty"`
+	TrustedProxies  []string         `json:"trusted_proxies,omitempty"`
+	ThemeDir        string           `json:"theme_dir,omitempty"`
+	Site            SiteConfig       `json:"site,omitempty"`
+	TLS             TLSConfig        `json:"tls,omitempty"`
+	ShutdownTimeout int              `json:"shutdown_timeout,omitempty"`
+	SessionState    string           `json:"session_state_file,omitempty"`
+	AdminAPI        AdminAPI         `json:"admin_api,omitempty"`
+	PasswordPolicy  PasswordPolicy   `json:"password_policy,omitempty"`
+	PasswordHash    PasswordHash     `json:"password_hash,omitempty"`
+	UserFile        UserFile         `json:"user_file,omitempty"`
+	Database        Database         `json:"database,omitempty"`
+	Session         SessionConfig    `json:"session,omitempty"`
+	CrossDomain     CrossDomain      `json:"cross_domain,omitempty"`
+	Cookie          CookieConfig     `json:"cookie,omitempty"`
+	TokenEncryption TokenEncryption  `json:"token_encryption,omitempty"`
+	Introspection   Introspection    `json:"introspection,omitempty"`
+	AuthCache       AuthCacheConfig  `json:"auth_cache,omitempty"`
+	Proxy           ProxyConfig      `json:"proxy,omitempty"`
+
+	// LegacyTokenDeadline 没有 kid 的旧令牌的截止时间，为空时使用最早到期的 previous_secrets 的 expires_at
+	LegacyTokenDeadline time.Time `json:"legacy_token_deadline,omitzero"`
+
+	// SecretRefs 从环境变量和文件解析出的敏感配置，字段路径（如 users[3].password）-> 原始值和解析后的值，保存配置时写回原始值
+	SecretRefs map[string]SecretRef `json:"-"`
+	// EnvOverrides 被 ARKAUTHN_* 环境变量覆盖的字段，字段路径 -> 配置文件中的原始值，保存配置时写回原始值
+	EnvOverrides map[string]json.RawMessage `json:"-"`
+	// Hash 配置文件内容的 SHA-256
+	Hash string `json:"-"`
+}
+
+// SecretRef Raw 为配置文件中的原始值，从 *_file 读取时为空；Value 为解析后的值
+type SecretRef struct {
+	Raw   string
+	Value string
 }
 
 type UserItem struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Nonce    string `json:"nonce,omitempty"`
+	Username            string   `json:"username" yaml:"username"`
+	Password            string   `json:"password" yaml:"password"`
+	PasswordFile        string   `json:"password_file,omitempty" yaml:"-"` // 从文件读取密码，只在主配置文件中有效
+	Nonce               string   `json:"nonce,omitempty" yaml:"nonce,omitempty"`
+	PasswordFingerprint string   `json:"password_fingerprint,omitempty" yaml:"password_fingerprint,omitempty"` // 由 ArkAuthn 维护，与密码不符时更换 Nonce
+	Admin               bool     `json:"admin,omitempty" yaml:"admin,omitempty"`
+	Groups              []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// SessionConfig 会话有效期，单位为秒
+// 设置 idle_timeout 后启用滑动续期：令牌在空闲超时内有效，访问时自动续期，直到登录时选择的时长或 max_lifetime
+// durations 为登录页可选的时长，超过 max_lifetime 的选项不展示
+type SessionConfig struct {
+	IdleTimeout     int             `json:"idle_timeout,omitempty"`
+	MaxLifetime     int             `json:"max_lifetime,omitempty"`
+	Durations       []int           `json:"durations,omitempty"`        // 默认 3600, 86400, 2592000, 31536000
+	DefaultDuration int             `json:"default_duration,omitempty"` // 默认选中的时长，默认为第一个可选项
+	Policies        []SessionPolicy `json:"policies,omitempty"`         // 按用户、用户组或目标域名覆盖，未设置的字段使用全局值
+}
+
+// SessionPolicy 同时设置多个匹配条件时需全部满足，hosts 匹配登录后跳转的目标域名及其子域名
+// 目标域名来自用户提交的跳转地址，含 hosts 的策略只能收紧限制，不能延长会话
+type SessionPolicy struct {
+	Users           []string `json:"users,omitempty"`
+	Groups          []string `json:"groups,omitempty"`
+	Hosts           []string `json:"hosts,omitempty"`
+	IdleTimeout     int      `json:"idle_timeout,omitempty"`
+	MaxLifetime     int      `json:"max_lifetime,omitempty"`
+	Durations       []int    `json:"durations,omitempty"`
+	DefaultDuration int      `json:"default_duration,omitempty"`
+}
+
+// CookieConfig 保存令牌的 Cookie
+// 名称以 __Host- 开头时 Cookie 只属于认证服务的域名，不能设置 domain 且 path 必须为 /；以 __Secure- 或 __Host- 开头时始终启用 Secure
+type CookieConfig struct {
+	Name     string `json:"name,omitempty"`      // 默认 arkauthn
+	Domain   string `json:"domain,omitempty"`    // 默认为认证服务的根域名
+	Path     string `json:"path,omitempty"`      // 默认 /
+	SameSite string `json:"same_site,omitempty"` // Lax、Strict 或 None，默认 Lax
+	Secure   *bool  `json:"secure,omitempty"`    // 默认在认证服务使用 https 时启用
+}
+
+// PreviousSecret 轮换前使用的密钥，expires_at 之前签发的令牌仍然有效，为空时不过期
+type PreviousSecret struct {
+	Secret     string    `json:"secret"`
+	SecretFile string    `json:"secret_file,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+}
+
+// TokenEncryption 令牌加密，启用后签发的令牌使用 JWE（dir + A256GCM）加密，避免令牌中的用户信息被读取
+// 未加密的令牌仍然可以使用，启用或关闭加密不会使已登录的用户失效
+type TokenEncryption struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Key     string `json:"key,omitempty"` // 加密密钥，默认由 secret 派生
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// AuthCacheConfig ForwardAuth 认证结果缓存，以令牌和目标域名为键，吊销会话、修改用户和重新加载配置时清空
+type AuthCacheConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	TTL     int  `json:"ttl,omitempty"`  // 缓存秒数，默认 5
+	Size    int  `json:"size,omitempty"` // 缓存大小，单位 MB，默认 8
+}
+
+// ProxyConfig 内置反向代理，请求的域名匹配 routes 时校验登录状态并转发到上游，不需要 Caddy 等支持 ForwardAuth 的代理
+type ProxyConfig struct {
+	Routes    []ProxyRoute `json:"routes,omitempty"`
+	BodyLimit int          `json:"body_limit,omitempty"` // 代理请求体大小上限，单位 MB，默认不限制
+}
+
+type ProxyRoute struct {
+	Host         string `json:"host"`                    // 访问的域名，如 app.example.com
+	Upstream     string `json:"upstream"`                // 上游地址，如 http://127.0.0.1:3000，可以包含路径前缀
+	PreserveHost bool   `json:"preserve_host,omitempty"` // 向上游传递原始的 Host，默认使用上游地址的 Host
+}
+
+// Introspection 令牌检查接口 /api/introspect（RFC 7662），后端使用客户端凭据校验收到的令牌，不需要知道 secret
+type Introspection struct {
+	Clients []IntrospectionClient `json:"clients,omitempty"`
+}
+
+type IntrospectionClient struct {
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret"`
+	ClientSecretFile string `json:"client_secret_file,omitempty"`
+}
+
+// CrossDomain 跨根域名单点登录
+// trusted_domains 中与认证服务根域名不同的站点，通过 ForwardAuth 回调交换一次性授权码，获得该站点域名下的 Cookie
+type CrossDomain struct {
+	Enabled      bool   `json:"enabled,omitempty"`
+	CallbackPath string `json:"callback_path,omitempty"` // 默认 /_arkauthn/callback
+}
+
+// Database SQLite 数据库，配置后用户、会话、管理接口密钥和审计事件保存在数据库中
+type Database struct {
+	Path           string `json:"path,omitempty"`
+	AuditRetention int    `json:"audit_retention,omitempty"` // 审计事件保留天数，默认 90
+}
+
+// UserFile 外部用户文件，配置后忽略配置文件中的 users
+// htpasswd 通常与 Nginx、Apache 共用，默认只读，writable 为 true 时才会写回，写入的密码使用 bcrypt
+type UserFile struct {
+	Path      string   `json:"path,omitempty"`
+	Format    string   `json:"format,omitempty"`     // htpasswd, yaml, json, csv，为空时根据扩展名判断
+	Admins    []string `json:"admins,omitempty"`     // 额外指定的管理员，用于 htpasswd 等无法保存管理员标记的格式
+	Writable  bool     `json:"writable,omitempty"`   // 允许写回 htpasswd 文件
+	StateFile string   `json:"state_file,omitempty"` // 保存 htpasswd 用户的 nonce 和密码指纹，强制下线和修改密码在重启后依然有效
 }
 
 type JailConfig struct {
-	Enabled     bool `json:"enabled"`
-	MaxAttempts int  `json:"max_attempts"`
-	BanDuration int  `json:"ban_duration"`
+	Enabled     bool   `json:"enabled"`
+	MaxAttempts int    `json:"max_attempts"`
+	BanDuration int    `json:"ban_duration"`
+	StateFile   string `json:"state_file,omitempty"`
+}
+
+type SiteConfig struct {
+	Name           string `json:"name,omitempty"`
+	Logo           string `json:"logo,omitempty"`
+	SupportContact string `json:"support_contact,omitempty"`
+}
+
+type TLSConfig struct {
+	CertFile string     `json:"cert_file,omitempty"`
+	KeyFile  string     `json:"key_file,omitempty"`
+	ACME     ACMEConfig `json:"acme,omitempty"`
+}
+
+type ACMEConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Domains      []string `json:"domains,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	CacheDir     string   `json:"cache_dir,omitempty"`
+	DirectoryURL string   `json:"directory_url,omitempty"`
+	CARoot       string   `json:"ca_root,omitempty"`
+	HTTPListen   string   `json:"http_listen,omitempty"`
+}
+
+type AdminAPI struct {
+	Listen    string       `json:"listen,omitempty"`
+	LocalOnly bool         `json:"local_only,omitempty"`
+	Keys      []APIKeyItem `json:"keys,omitempty"`
+}
+
+type APIKeyItem struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+type PasswordPolicy struct {
+	MinLength    int    `json:"min_length,omitempty"`
+	MinStrength  int    `json:"min_strength,omitempty"`
+	BreachedFile string `json:"breached_file,omitempty"`
+}
+
+// PasswordHash 新密码使用的哈希算法，登录成功时明文和其他算法的密码会自动升级
+type PasswordHash struct {
+	Algorithm     string `json:"algorithm,omitempty"` // bcrypt(默认), argon2id, scrypt, pbkdf2-sha256, pbkdf2-sha512
+	DisableRehash bool   `json:"disable_rehash,omitempty"`
 }
@@ -1,6 +1,90 @@
 package vars
 
+import "time"
+
 type SlidingWindowLimiterIFace interface {
 	IsLimited(string) bool
 	RecordError(string)
+	Jailed() []JailedIP
+	Unban(string)
+}
+
+type AuditLogIFace interface {
+	Record(AuditEvent)
+	Recent(int) []AuditEvent
+}
+
+type SessionStoreIFace interface {
+	Create(Session)
+	List(username string) []Session
+	Revoke(id string) bool
+	RevokeUser(username string) int
+	IsRevoked(id string) bool
+	Extend(id string, expiresAt time.Time)
+}
+
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// DecisionCacheIFace ForwardAuth 认证结果缓存
+// 认证前通过 Generation 取得当前代数，Set 时代数已被 Clear 改变则不保存，避免缓存清空前得到的结果
+type DecisionCacheIFace interface {
+	Get(token, host string) (username string, allowed bool, ok bool)
+	Generation() uint64
+	Set(token, host, username string, allowed bool, expire time.Time, generation uint64)
+	Clear()
+}
+
+// UserStoreIFace 用户数据来源，Update 中 fn 返回错误时不做任何修改
+type UserStoreIFace interface {
+	Get(username string) (UserItem, bool)
+	List() []UserItem
+	Update(fn func(users []UserItem) ([]UserItem, error)) error
+}
+
+// SharedUserStoreIFace 可选接口，用户数据来源与其他服务共用时实现
+type SharedUserStoreIFace interface {
+	// ReadOnly 不能添加、删除用户和修改密码
+	ReadOnly() bool
+	// PasswordHashAlgorithm 写入的密码使用的哈希算法，为空时使用 password_hash.algorithm
+	PasswordHashAlgorithm() string
+	// RequireHashedPasswords 无法识别的密码格式不按明文比较，明文密码需要 {PLAIN} 前缀
+	RequireHashedPasswords() bool
+}
+
+// APIKeyStoreIFace 保存在配置文件以外的管理接口密钥
+type APIKeyStoreIFace interface {
+	LookupAPIKey(key string) (name string, ok bool)
+}
+
+// MFASecretStoreIFace 保存用户的 MFA 密钥，按用户名和类型（如 totp）区分
+type MFASecretStoreIFace interface {
+	GetMFASecret(username, typ string) (secret string, ok bool, err error)
+	SetMFASecret(username, typ, secret string) error
+	DeleteMFASecret(username, typ string) error
+}
+
+type PwnedPasswordIFace interface {
+	IsPwned(password string) (bool, error)
+}
+
+type JailedIP struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
 }
@@ -1,13 +1,50 @@
 package vars
 
-import "github.com/zjyl1994/cap-go"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/zjyl1994/cap-go"
+)
 
 var (
-	Config          ConfigFile
+	ConfigPath      string
+	ConfigMu        sync.Mutex // 修改并保存配置时加锁，保证基于当前配置的修改不会互相覆盖，读取配置不需要加锁
 	AuthRateLimiter SlidingWindowLimiterIFace
+	AuditLog        AuditLogIFace
+	SessionStore    SessionStoreIFace
+	UserStore       UserStoreIFace
+	APIKeyStore     APIKeyStoreIFace
+	MFASecretStore  MFASecretStoreIFace // 只有配置数据库时可用
+	PwnedPasswords  PwnedPasswordIFace
+	AuthCache       DecisionCacheIFace
 	CapInstance     cap.ICap
 )
 
+// config 当前配置的快照，发布后不再修改，重新加载或修改配置时整体替换
+var config atomic.Pointer[ConfigFile]
+
+func init() {
+	config.Store(&ConfigFile{})
+}
+
+// Config 返回当前配置的快照，调用方不能修改其中的字段
+// 同一请求内需要读取多个相关字段时应保存返回值，避免读到不同版本的配置
+func Config() *ConfigFile {
+	return config.Load()
+}
+
+// SetConfig 发布新的配置，修改配置时先复制 Config() 的值，修改副本后再发布
+func SetConfig(conf ConfigFile) {
+	config.Store(&conf)
+}
+
+// 构建信息，通过 -ldflags "-X" 注入
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
 const (
 	APP_NAME = "ARKAUTHN"
 )
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/csrf"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	csrfKey            = "csrf"
+	adminAuditPageSize = 100
+)
+
+// newCSRFMiddleware 创建表单 CSRF 校验中间件，令牌通过 {{.csrf}} 传给模板
+func newCSRFMiddleware() fiber.Handler {
+	return csrf.New(csrf.Config{
+		KeyLookup:      "form:_csrf",
+		CookieName:     "arkauthn_csrf",
+		CookieHTTPOnly: true,
+		CookieSameSite: "Strict",
+		Expiration:     time.Hour,
+		ContextKey:     csrfKey,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			logrus.Warnf("CSRF check failed %s: %v", c.IP(), err)
+			return renderError(c, http.StatusForbidden, "error.csrf")
+		},
+	})
+}
+
+func registerAdminRoutes(app *fiber.App, csrfProtect fiber.Handler) {
+	admin := app.Group("/admin", requireAdmin, csrfProtect)
+	admin.Get("/", adminIndexHandler)
+	admin.Post("/users", adminCreateUserHandler)
+	admin.Post("/users/:username", adminUpdateUserHandler)
+	admin.Post("/users/:username/password", adminResetPasswordHandler)
+	admin.Post("/users/:username/logout", adminForceLogoutHandler)
+	admin.Post("/users/:username/delete", adminDeleteUserHandler)
+	admin.Post("/jail/unban", adminUnbanHandler)
+	admin.Post("/trusted-domains", adminTrustedDomainsHandler)
+}
+
+// requireAdmin 仅允许管理员访问，未登录时跳转到登录页
+func requireAdmin(c *fiber.Ctx) error {
+	userinfo, ok := c.Locals(authUserKey).(authUserType)
+	if !ok {
+		return c.Redirect("/?r="+url.QueryEscape(c.OriginalURL()), fiber.StatusSeeOther)
+	}
+	if !isAdmin(userinfo.Username) {
+		logrus.Warnf("Non-admin user %s tried to access %s", userinfo.Username, c.Path())
+		return renderError(c, http.StatusForbidden, "error.forbidden")
+	}
+	return c.Next()
+}
+
+func isAdmin(username string) bool {
+	u, ok := vars.UserStore.Get(username)
+	return ok && u.Admin
+}
+
+func adminIndexHandler(c *fiber.Ctx) error {
+	var jailed []vars.JailedIP
+	if vars.AuthRateLimiter != nil {
+		jailed = vars.AuthRateLimiter.Jailed()
+	}
+	var events []vars.AuditEvent
+	if vars.AuditLog != nil {
+		events = vars.AuditLog.Recent(adminAuditPageSize)
+	}
+	userinfo := c.Locals(authUserKey).(authUserType)
+	// 仅展示管理页面自身的错误提示
+	errKey := c.Query("error")
+	if !strings.HasPrefix(errKey, "admin.error.") {
+		errKey = ""
+	}
+	return c.Render("admin", fiber.Map{
+		"username":        userinfo.Username,
+		"users":           vars.UserStore.List(),
+		"jail_enabled":    vars.AuthRateLimiter != nil,
+		"jailed":          jailed,
+		"events":          events,
+		"trusted_domains": strings.Join(vars.Config().TrustedDomains, "\n"),
+		"ok":              c.Query("ok") != "",
+		"error":           errKey,
+	})
+}
+
+// updateUsers 修改用户列表并保存到用户数据来源，fn 返回错误时不做任何修改
+// 修改在副本上进行，正在读取旧列表的请求不受影响
+// 用户文件不允许的修改转换为 adminError
+func updateUsers(fn func(users []vars.UserItem) ([]vars.UserItem, error)) error {
+	err := vars.UserStore.Update(fn)
+	switch {
+	case errors.Is(err, utils.ErrUserFileReadOnly):
+		return adminError("admin.error.user_file_read_only")
+	case errors.Is(err, utils.ErrHtpasswdUserAttributes):
+		return adminError("admin.error.htpasswd_attributes")
+	case errors.Is(err, utils.ErrConfigEnvOverridden):
+		return adminError("admin.error.env_overridden")
+	}
+	return err
+}
+
+// adminError 用于在管理页面展示的错误，值为翻译键
+type adminError string
+
+func (e adminError) Error() string { return string(e) }
+
+func adminRedirect(c *fiber.Ctx, action string, err error) error {
+	operator := c.Locals(authUserKey).(authUserType).Username
+	if err != nil {
+		if key, ok := err.(adminError); ok {
+			return c.Redirect("/admin?error="+string(key), fiber.StatusSeeOther)
+		}
+		logrus.Errorf("Admin action %s by %s failed: %v", action, operator, err)
+		return c.Redirect("/admin?error=admin.error.save_failed", fiber.StatusSeeOther)
+	}
+	recordAudit(c, auditAdminAction, operator, action)
+	return c.Redirect("/admin?ok=1", fiber.StatusSeeOther)
+}
+
+func findUser(users []vars.UserItem, username string) int {
+	return slices.IndexFunc(users, func(u vars.UserItem) bool { return u.Username == username })
+}
+
+func adminCreateUserHandler(c *fiber.Ctx) error {
+	username := strings.TrimSpace(c.FormValue("username"))
+	password := c.FormValue("password")
+	admin := c.FormValue("admin") != ""
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		if username == "" || password == "" {
+			return nil, adminError("admin.error.required")
+		}
+		if findUser(users, username) >= 0 {
+			return nil, adminError("admin.error.user_exists")
+		}
+		hash, err := hashUserPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		return append(users, vars.UserItem{
+			Username: username,
+			Password: hash,
+			Nonce:    utils.RandString(16),
+			Admin:    admin,
+		}), nil
+	})
+	return adminRedirect(c, fmt.Sprintf("create user %s admin=%t", username, admin), err)
+}
+
+func adminUpdateUserHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	admin := c.FormValue("admin") != ""
+	operator := c.Locals(authUserKey).(authUserType).Username
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		if username == operator && !admin {
+			return nil, adminError("admin.error.self")
+		}
+		users[idx].Admin = admin
+		return users, nil
+	})
+	return adminRedirect(c, fmt.Sprintf("update user %s admin=%t", username, admin), err)
+}
+
+func adminResetPasswordHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	password := c.FormValue("password")
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		if password == "" {
+			return nil, adminError("admin.error.required")
+		}
+		hash, err := hashUserPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		users[idx].Password = hash
+		// 更换 Nonce 使该用户已签发的令牌失效
+		users[idx].Nonce = utils.RandString(16)
+		return users, nil
+	})
+	if err == nil && vars.SessionStore != nil {
+		vars.SessionStore.RevokeUser(username)
+	}
+	return adminRedirect(c, "reset password of "+username, err)
+}
+
+// adminForceLogoutHandler 更换用户的 Nonce，使该用户已签发的令牌全部失效
+func adminForceLogoutHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		users[idx].Nonce = utils.RandString(16)
+		return users, nil
+	})
+	return adminRedirect(c, "force logout "+username, err)
+}
+
+func adminDeleteUserHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	operator := c.Locals(authUserKey).(authUserType).Username
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		if username == operator {
+			return nil, adminError("admin.error.self")
+		}
+		return slices.Delete(users, idx, idx+1), nil
+	})
+	return adminRedirect(c, "delete user "+username, err)
+}
+
+func adminUnbanHandler(c *fiber.Ctx) error {
+	ip := c.FormValue("ip")
+	if vars.AuthRateLimiter != nil && ip != "" {
+		vars.AuthRateLimiter.Unban(ip)
+	}
+	return adminRedirect(c, "unban "+ip, nil)
+}
+
+func adminTrustedDomainsHandler(c *fiber.Ctx) error {
+	var domains []string
+	for _, line := range strings.Split(c.FormValue("trusted_domains"), "\n") {
+		if domain := strings.ToLower(strings.TrimSpace(line)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	vars.ConfigMu.Lock()
+	conf := *vars.Config()
+	conf.TrustedDomains = domains
+	err := utils.SaveConfig(conf)
+	vars.ConfigMu.Unlock()
+	if errors.Is(err, utils.ErrConfigEnvOverridden) {
+		err = adminError("admin.error.env_overridden")
+	}
+	return adminRedirect(c, "update trusted domains: "+strings.Join(domains, ","), err)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// 管理页面修改 trusted_domains 和用户、重新加载配置时，正在处理的认证请求同时读取，需要使用 go test -race 检查
+func TestAdminUpdateConcurrentReads(t *testing.T) {
+	setupTestConfig(t, testProxyConfig())
+	oldPath := vars.ConfigPath
+	t.Cleanup(func() { vars.ConfigPath = oldPath })
+	vars.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+
+	app := fiber.New(fiber.Config{Immutable: true})
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(authUserKey, authUserType{Username: "alice"})
+		return c.Next()
+	})
+	app.Post("/admin/trusted_domains", adminTrustedDomainsHandler)
+	app.Post("/admin/users", adminCreateUserHandler)
+
+	post := func(path string, form url.Values) {
+		req := httptest.NewRequest(fiber.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			crossDomainTarget("https://app.trusted.net/")
+			isSafeRedirect("https://app.trusted.net/", "example.com")
+			vars.UserStore.Get("alice")
+			vars.UserStore.List()
+			if token, err := utils.GenerateToken("alice", "s1", time.Hour, 0); err != nil {
+				t.Error(err)
+			} else if _, err := utils.ParseToken(token); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	// 与重新加载配置相同，整体替换配置
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			vars.ConfigMu.Lock()
+			conf := *vars.Config()
+			conf.LogLevel = "debug"
+			vars.SetConfig(conf)
+			vars.ConfigMu.Unlock()
+		}
+	}()
+	for i := range 10 {
+		post("/admin/trusted_domains", url.Values{"trusted_domains": {"trusted.net\nother.net"}})
+		post("/admin/users", url.Values{"username": {"user" + string(rune('a'+i))}, "password": {"pass"}})
+	}
+	close(done)
+	wg.Wait()
+
+	if _, ok := crossDomainTarget("https://app.trusted.net/"); !ok {
+		t.Error("trusted.net should be a cross-domain target")
+	}
+	if got := vars.Config().TrustedDomains; !slices.Equal(got, []string{"trusted.net", "other.net"}) {
+		t.Errorf("trusted domains = %v", got)
+	}
+	if n := len(vars.UserStore.List()); n != 11 {
+		t.Errorf("users = %d, want 11", n)
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/i18n"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const apiKeyNameKey = "__API_KEY_NAME__"
+
+var configReloader func() error
+
+// SetConfigReloader 设置重新加载配置的方法，供管理接口调用
+func SetConfigReloader(fn func() error) {
+	configReloader = fn
+}
+
+func newAdminAPIApp() *fiber.App {
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		Immutable:             true,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			code := fiber.StatusInternalServerError
+			var e *fiber.Error
+			if errors.As(err, &e) {
+				code = e.Code
+			}
+			return c.Status(code).JSON(fiber.Map{"error": err.Error()})
+		},
+	})
+	app.Use(recover.New())
+	v1 := app.Group("/api/v1", apiKeyMiddleware)
+	v1.Get("/users", apiListUsersHandler)
+	v1.Post("/users", apiCreateUserHandler)
+	v1.Get("/users/:username", apiGetUserHandler)
+	v1.Put("/users/:username", apiUpdateUserHandler)
+	v1.Delete("/users/:username", apiDeleteUserHandler)
+	v1.Get("/users/:username/sessions", apiListSessionsHandler)
+	v1.Delete("/users/:username/sessions", apiRevokeUserSessionsHandler)
+	v1.Get("/sessions", apiListSessionsHandler)
+	v1.Delete("/sessions/:id", apiRevokeSessionHandler)
+	v1.Get("/jail", apiListJailHandler)
+	v1.Delete("/jail/:ip", apiUnbanHandler)
+	v1.Post("/config/reload", apiReloadConfigHandler)
+	v1.Post("/tokens", apiIssueTokenHandler)
+	v1.Post("/tokens/introspect", apiIntrospectTokenHandler)
+	return app
+}
+
+// runAdminAPI 在独立的监听地址上运行管理接口
+func runAdminAPI(app *fiber.App, listen string) error {
+	ln, err := listenWithRetry(listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infoln("Admin API running in", listen)
+	return app.Listener(ln)
+}
+
+// apiKeyMiddleware 校验 Authorization: Bearer <key> 或 X-API-Key 请求头
+func apiKeyMiddleware(c *fiber.Ctx) error {
+	if vars.Config().AdminAPI.LocalOnly && !c.Context().RemoteIP().IsLoopback() {
+		return fiber.NewError(fiber.StatusForbidden, "admin api is restricted to localhost")
+	}
+	if name, ok := lookupAPIKey(c); ok {
+		c.Locals(apiKeyNameKey, name)
+		return c.Next()
+	}
+	logrus.Warnf("Invalid admin api key from %s", c.IP())
+	return fiber.NewError(fiber.StatusUnauthorized, "invalid api key")
+}
+
+// lookupAPIKey 在配置文件和数据库中查找请求携带的管理接口密钥，返回密钥名称
+func lookupAPIKey(c *fiber.Ctx) (string, bool) {
+	key, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok {
+		key = c.Get("X-API-Key")
+	}
+	if key == "" {
+		return "", false
+	}
+	for _, item := range vars.Config().AdminAPI.Keys {
+		if item.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(item.Key)) == 1 {
+			return item.Name, true
+		}
+	}
+	if vars.APIKeyStore != nil {
+		return vars.APIKeyStore.LookupAPIKey(key)
+	}
+	return "", false
+}
+
+func apiAudit(c *fiber.Ctx, action string) {
+	name, _ := c.Locals(apiKeyNameKey).(string)
+	recordAudit(c, auditAdminAction, "api:"+name, action)
+}
+
+// apiUpdateError 将用户修改的错误转换为接口错误
+func apiUpdateError(err error) error {
+	var key adminError
+	if errors.As(err, &key) {
+		switch key {
+		case "admin.error.user_not_found":
+			return fiber.NewError(fiber.StatusNotFound, "user not found")
+		case "admin.error.user_exists":
+			return fiber.NewError(fiber.StatusConflict, "user already exists")
+		case "admin.error.env_overridden":
+			return fiber.NewError(fiber.StatusConflict, "users are overridden by environment variable")
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, i18n.T("en", string(key)))
+		}
+	}
+	return err
+}
+
+type apiUser struct {
+	Username string   `json:"username"`
+	Admin    bool     `json:"admin"`
+	Groups   []string `json:"groups"`
+}
+
+func toAPIUser(u vars.UserItem) apiUser {
+	return apiUser{Username: u.Username, Admin: u.Admin, Groups: u.Groups}
+}
+
+func apiListUsersHandler(c *fiber.Ctx) error {
+	users := vars.UserStore.List()
+	result := make([]apiUser, 0, len(users))
+	for _, u := range users {
+		result = append(result, toAPIUser(u))
+	}
+	return c.JSON(result)
+}
+
+func apiGetUserHandler(c *fiber.Ctx) error {
+	u, ok := vars.UserStore.Get(c.Params("username"))
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+	return c.JSON(toAPIUser(u))
+}
+
+func apiCreateUserHandler(c *fiber.Ctx) error {
+	var req struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Admin    bool     `json:"admin"`
+		Groups   []string `json:"groups"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		if req.Username == "" || req.Password == "" {
+			return nil, adminError("admin.error.required")
+		}
+		if findUser(users, req.Username) >= 0 {
+			return nil, adminError("admin.error.user_exists")
+		}
+		hash, err := hashUserPassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		return append(users, vars.UserItem{
+			Username: req.Username,
+			Password: hash,
+			Nonce:    utils.RandString(16),
+			Admin:    req.Admin,
+			Groups:   req.Groups,
+		}), nil
+	})
+	if err != nil {
+		return apiUpdateError(err)
+	}
+	apiAudit(c, fmt.Sprintf("create user %s admin=%t", req.Username, req.Admin))
+	return c.Status(fiber.StatusCreated).JSON(apiUser{Username: req.Username, Admin: req.Admin, Groups: req.Groups})
+}
+
+func apiUpdateUserHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	var req struct {
+		Password *string   `json:"password"`
+		Admin    *bool     `json:"admin"`
+		Groups   *[]string `json:"groups"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	var updated vars.UserItem
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		if req.Password != nil {
+			if *req.Password == "" {
+				return nil, adminError("admin.error.required")
+			}
+			hash, err := hashUserPassword(*req.Password)
+			if err != nil {
+				return nil, err
+			}
+			users[idx].Password = hash
+			// 更换 Nonce 使该用户已签发的令牌失效
+			users[idx].Nonce = utils.RandString(16)
+		}
+		if req.Admin != nil {
+			users[idx].Admin = *req.Admin
+		}
+		if req.Groups != nil {
+			users[idx].Groups = *req.Groups
+		}
+		updated = users[idx]
+		return users, nil
+	})
+	if err != nil {
+		return apiUpdateError(err)
+	}
+	if req.Password != nil && vars.SessionStore != nil {
+		vars.SessionStore.RevokeUser(username)
+	}
+	apiAudit(c, fmt.Sprintf("update user %s password=%t admin=%t", username, req.Password != nil, updated.Admin))
+	return c.JSON(toAPIUser(updated))
+}
+
+func apiDeleteUserHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		return slices.Delete(users, idx, idx+1), nil
+	})
+	if err != nil {
+		return apiUpdateError(err)
+	}
+	if vars.SessionStore != nil {
+		vars.SessionStore.RevokeUser(username)
+	}
+	apiAudit(c, "delete user "+username)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func apiListSessionsHandler(c *fiber.Ctx) error {
+	if vars.SessionStore == nil {
+		return c.JSON([]vars.Session{})
+	}
+	username := c.Params("username", c.Query("username"))
+	sessions := vars.SessionStore.List(username)
+	if sessions == nil {
+		sessions = []vars.Session{}
+	}
+	return c.JSON(sessions)
+}
+
+func apiRevokeSessionHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if vars.SessionStore == nil || !vars.SessionStore.Revoke(id) {
+		return fiber.NewError(fiber.StatusNotFound, "session not found")
+	}
+	apiAudit(c, "revoke session "+id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// apiRevokeUserSessionsHandler 吊销用户的全部会话
+// 同时更换 Nonce，使未被记录的旧令牌也失效
+func apiRevokeUserSessionsHandler(c *fiber.Ctx) error {
+	username := c.Params("username")
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		users[idx].Nonce = utils.RandString(16)
+		return users, nil
+	})
+	if err != nil {
+		return apiUpdateError(err)
+	}
+	revoked := 0
+	if vars.SessionStore != nil {
+		revoked = vars.SessionStore.RevokeUser(username)
+	}
+	apiAudit(c, "revoke all sessions of "+username)
+	return c.JSON(fiber.Map{"revoked": revoked})
+}
+
+func apiListJailHandler(c *fiber.Ctx) error {
+	jailed := []vars.JailedIP{}
+	if vars.AuthRateLimiter != nil {
+		jailed = append(jailed, vars.AuthRateLimiter.Jailed()...)
+	}
+	return c.JSON(jailed)
+}
+
+func apiUnbanHandler(c *fiber.Ctx) error {
+	if vars.AuthRateLimiter == nil {
+		return fiber.NewError(fiber.StatusNotFound, "jail is disabled")
+	}
+	ip := c.Params("ip")
+	vars.AuthRateLimiter.Unban(ip)
+	apiAudit(c, "unban "+ip)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func apiReloadConfigHandler(c *fiber.Ctx) error {
+	if configReloader == nil {
+		return fiber.NewError(fiber.StatusNotImplemented, "config reload is not available")
+	}
+	if err := configReloader(); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	apiAudit(c, "reload config")
+	return c.JSON(fiber.Map{"config_hash": vars.Config().Hash})
+}
+
+func apiIssueTokenHandler(c *fiber.Ctx) error {
+	var req struct {
+		Username string `json:"username"`
+		Duration int64  `json:"duration"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if _, ok := vars.UserStore.Get(req.Username); !ok {
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+	if req.Duration <= 0 {
+		req.Duration = 3600
+	}
+	token, expireAt, err := issueFixedSession(c, req.Username, time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		return err
+	}
+	// 超过 max_lifetime 的时长已被截断，记录实际的有效期
+	apiAudit(c, fmt.Sprintf("issue token for %s duration=%ds", req.Username, int64(time.Until(expireAt).Round(time.Second)/time.Second)))
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token":      token,
+		"expires_at": expireAt,
+	})
+}
+
+func apiIntrospectTokenHandler(c *fiber.Ctx) error {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	claims, err := utils.ParseToken(req.Token)
+	if err != nil || isSessionRevoked(claims.ID) {
+		return c.JSON(fiber.Map{"active": false})
+	}
+	result := fiber.Map{
+		"active":     true,
+		"username":   claims.Username,
+		"session_id": claims.ID,
+		"expires_at": claims.ExpiresAt.Time,
+	}
+	if claims.IssuedAt != nil {
+		result["issued_at"] = claims.IssuedAt.Time
+	}
+	return c.JSON(result)
+}
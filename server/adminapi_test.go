@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func TestAPIIssueTokenMaxLifetime(t *testing.T) {
+	conf := testProxyConfig()
+	conf.Session.MaxLifetime = 3600
+	setupTestConfig(t, conf)
+	app := fiber.New()
+	app.Post("/api/v1/tokens", apiIssueTokenHandler)
+
+	tests := []struct {
+		duration int
+		want     time.Duration
+	}{
+		{600, 600 * time.Second},
+		{86400 * 365, time.Hour},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", strings.NewReader(`{"username":"alice","duration":`+strconv.Itoa(tt.duration)+`}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		claims, err := utils.ParseToken(body.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := claims.ExpiresAt.Sub(claims.IssuedAt.Time); got != tt.want {
+			t.Errorf("duration %d: token lifetime = %s, want %s", tt.duration, got, tt.want)
+		}
+		if len(claims.ID) < 43 {
+			t.Errorf("session id %q is too short", claims.ID)
+		}
+	}
+}
+
+// users 被环境变量覆盖时写入配置文件不会生效，接口拒绝修改
+func TestAPICreateUserEnvOverridden(t *testing.T) {
+	conf := testProxyConfig()
+	conf.EnvOverrides = map[string]json.RawMessage{"users": json.RawMessage("null")}
+	setupTestConfig(t, conf)
+	oldPath := vars.ConfigPath
+	t.Cleanup(func() { vars.ConfigPath = oldPath })
+	vars.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+
+	app := fiber.New()
+	app.Post("/api/v1/users", apiCreateUserHandler)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"username":"bob","password":"pass"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusConflict {
+		t.Errorf("status = %d, want %d", resp.StatusCode, fiber.StatusConflict)
+	}
+	if _, ok := vars.UserStore.Get("bob"); ok {
+		t.Error("user bob was created")
+	}
+	if _, err := os.Stat(vars.ConfigPath); !os.IsNotExist(err) {
+		t.Errorf("config file written: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// 审计事件类型
+const (
+	auditLoginSuccess = "login_success"
+	auditLoginFailure = "login_failure"
+	auditLoginJailed  = "login_jailed"
+	auditLogout       = "logout"
+	auditSSOLogin     = "sso_login"
+	auditAdminAction  = "admin_action"
+)
+
+// recordAudit 记录审计事件，username 为操作涉及的用户
+func recordAudit(c *fiber.Ctx, eventType, username, detail string) {
+	if vars.AuditLog == nil {
+		return
+	}
+	event := vars.AuditEvent{
+		Time:     time.Now(),
+		Type:     eventType,
+		Username: username,
+		IP:       c.IP(),
+		Detail:   detail,
+	}
+	vars.AuditLog.Record(event)
+	logrus.Debugf("Audit %s user=%s ip=%s %s", event.Type, event.Username, event.IP, event.Detail)
+}
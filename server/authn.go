@@ -1,7 +1,6 @@
 package server
 
 import (
-	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,63 +11,114 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/zjyl1994/arkauthn/infra/utils"
 	"github.com/zjyl1994/arkauthn/infra/vars"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var dummyBcryptHash []byte
-
-func init() {
-	dummyBcryptHash, _ = bcrypt.GenerateFromPassword([]byte("dummy_password_for_timing_protection"), bcrypt.DefaultCost)
-}
-
 func forwardAuthHandler(c *fiber.Ctx) error {
 	forwardMethod := c.Get("X-Forwarded-Method")
 	forwardUri := fmt.Sprintf("%s://%s%s", c.Get("X-Forwarded-Proto"), c.Get("X-Forwarded-Host"), c.Get("X-Forwarded-Uri"))
 	logrus.Debugf("ForwardAuth with %s %s", forwardMethod, forwardUri)
-	userinfo, ok := c.Locals(authUserKey).(authUserType)
+	if vars.Config().CrossDomain.Enabled {
+		if u, err := url.Parse(forwardUri); err == nil && u.Path == ssoCallbackPath() {
+			return ssoCallback(c, u)
+		}
+	}
+	// Caddy 的 forward_auth 不会把 2xx 响应中的 Set-Cookie 交给浏览器，页面请求需要续期时跳转到认证服务续期
+	navigation := strings.EqualFold(forwardMethod, "GET") && isNavigation(c)
+	if navigation {
+		c.Locals(renewDeferKey, true)
+	}
+	userinfo, ok := cachedAuthenticate(c, c.Get("X-Forwarded-Host"))
 	if !ok {
 		if strings.EqualFold(forwardMethod, "GET") {
-			u, err := url.Parse(vars.Config.Redirect)
-			if err != nil {
-				logrus.Errorf("Invalid redirect config: %v", err)
-				return c.Status(http.StatusInternalServerError).SendString("Internal Server Error")
-			}
-			query := u.Query()
-			query.Set("r", forwardUri)
-			u.RawQuery = query.Encode()
-			return c.Redirect(u.String(), fiber.StatusSeeOther)
+			return redirectToLogin(c, forwardUri)
 		} else {
 			return c.SendStatus(http.StatusUnauthorized)
 		}
 	}
+	if due, _ := c.Locals(renewDueKey).(bool); due {
+		logrus.Debugf("ForwardAuth redirect to renew session of %s", userinfo.Username)
+		return redirectToAuthPage(c, "renew", forwardUri)
+	}
 	c.Set("Remote-User", userinfo.Username)
 	c.Set("X-Forwarded-User", userinfo.Username)
 	logrus.Debugf("ForwardAuth success with user:%s", userinfo.Username)
 	return c.SendStatus(http.StatusNoContent)
 }
 
+// isNavigation 判断 ForwardAuth 转发的请求是否为浏览器的页面导航，只有页面导航可以跳转
+// 旧版本浏览器没有 Sec-Fetch-Mode，按 Accept 判断
+func isNavigation(c *fiber.Ctx) bool {
+	if mode := c.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(c.Get(fiber.HeaderAccept), fiber.MIMETextHTML)
+}
+
+// redirectToLogin 跳转到登录页，登录后返回 target
+func redirectToLogin(c *fiber.Ctx, target string) error {
+	return redirectToAuthPage(c, "", target)
+}
+
+// redirectToAuthPage 跳转到认证服务的 page 页面，处理完成后返回 target
+func redirectToAuthPage(c *fiber.Ctx, page, target string) error {
+	base, err := url.Parse(vars.Config().Redirect)
+	if err != nil {
+		logrus.Errorf("Invalid redirect config: %v", err)
+		return c.Status(http.StatusInternalServerError).SendString("Internal Server Error")
+	}
+	u := base
+	if page != "" {
+		u = base.ResolveReference(&url.URL{Path: page})
+	}
+	query := u.Query()
+	query.Set("r", target)
+	u.RawQuery = query.Encode()
+	return c.Redirect(u.String(), fiber.StatusSeeOther)
+}
+
+// cachedAuthenticate 校验访问 host 的请求中的令牌，启用 auth_cache 时优先使用缓存的结果
+func cachedAuthenticate(c *fiber.Ctx, host string) (authUserType, bool) {
+	if vars.AuthCache == nil {
+		return authenticate(c)
+	}
+	token, _ := requestToken(c)
+	if token == "" {
+		return authUserType{}, false
+	}
+	if username, allowed, ok := vars.AuthCache.Get(token, host); ok {
+		logrus.Debugf("Auth cache hit for %s", host)
+		return authUserType{Username: username}, allowed
+	}
+	generation := vars.AuthCache.Generation()
+	userinfo, ok := authenticate(c)
+	expire := time.Now().Add(time.Duration(vars.Config().AuthCache.TTL) * time.Second)
+	if ok && userinfo.Expire.Before(expire) {
+		expire = userinfo.Expire
+	}
+	vars.AuthCache.Set(token, host, userinfo.Username, ok, expire, generation)
+	return userinfo, ok
+}
+
 func loginAuthnHandler(c *fiber.Ctx) error {
 	var req struct {
 		Username string `json:"username" form:"username"`
 		Password string `json:"password" form:"password"`
 		Redirect string `json:"redirect" form:"redirect"`
 		CapToken string `json:"cap_token" form:"cap_token"`
-		Duration int64  `json:"duration" form:"duration"`
+		Duration int    `json:"duration" form:"duration"`
 	}
 	err := c.BodyParser(&req)
 	if err != nil {
 		return err
 	}
 	if req.CapToken == "" || !vars.CapInstance.ValidateToken(req.CapToken, false) {
-		return c.Status(fiber.StatusUnauthorized).SendString("Invalid cap token")
-	}
-	if req.Duration < 3600 || req.Duration > 31536000 {
-		req.Duration = 3600
+		return renderError(c, fiber.StatusUnauthorized, "error.invalid_cap_token")
 	}
 	ipAddr := c.IP()
 	if vars.AuthRateLimiter != nil && vars.AuthRateLimiter.IsLimited(ipAddr) {
 		logrus.Warnf("Too many login attempts %s", ipAddr)
-		return c.Status(http.StatusTooManyRequests).SendString("Too many login attempts")
+		recordAudit(c, auditLoginJailed, req.Username, "")
+		return renderError(c, http.StatusTooManyRequests, "error.too_many_attempts")
 	}
 	logrus.Debugf("Access Remote IP %s", ipAddr)
 	user, ok := checkUser(req.Username, req.Password)
@@ -77,7 +127,8 @@ func loginAuthnHandler(c *fiber.Ctx) error {
 			vars.AuthRateLimiter.RecordError(ipAddr)
 		}
 		logrus.Warnf("Invalid login attempt %s", ipAddr) // 记录警告日志方便后续fail2ban
-		u, uerr := url.Parse(vars.Config.Redirect)
+		recordAudit(c, auditLoginFailure, req.Username, "")
+		u, uerr := url.Parse(vars.Config().Redirect)
 		if uerr != nil {
 			return uerr
 		}
@@ -89,131 +140,193 @@ func loginAuthnHandler(c *fiber.Ctx) error {
 		u.RawQuery = q.Encode()
 		return c.Redirect(u.String())
 	}
+	host := redirectHost(req.Redirect)
+	duration := resolveLoginDuration(sessionPolicyFor(user, host), req.Duration)
+	recordAudit(c, auditLoginSuccess, user, fmt.Sprintf("duration=%ds", duration))
+	breached := isBreachedPassword(req.Password)
+	if breached {
+		logrus.Warnf("User %s logged in with a breached password", user)
+		recordAudit(c, auditBreachedPassword, user, "")
+	}
+	upgradePasswordHash(user, req.Password)
 	// 生成JWT令牌
-	dur := time.Duration(req.Duration) * time.Second
-	token, err := utils.GenerateToken(user, dur)
+	dur := time.Duration(duration) * time.Second
+	token, expireAt, err := issueSession(c, user, host, dur)
 	if err != nil {
 		return err
 	}
 	// 设置cookie
-	rootDomain, err := utils.ExtractRootDomain(vars.Config.Redirect)
+	rootDomain, err := setAuthCookie(c, token, expireAt)
 	if err != nil {
 		return err
 	}
-	expireAt := time.Now().Add(dur)
-	cookie := &fiber.Cookie{
-		Name:     "arkauthn",
-		Value:    token,
-		Expires:  expireAt,
-		HTTPOnly: true,
-		Secure:   strings.HasPrefix(vars.Config.Redirect, "https") || c.Protocol() == "https",
-		SameSite: "Lax",
-		Domain:   "." + rootDomain,
-	}
-	c.Cookie(cookie)
-	// 重定向
-	if len(req.Redirect) > 0 {
-		// 检查重定向URL是否安全 (Open Redirect Protection)
-		safeRedirect := false
-		if strings.HasPrefix(req.Redirect, "/") && !strings.HasPrefix(req.Redirect, "//") {
-			safeRedirect = true
+	// 重定向，使用泄露密码登录时先在用户信息页提示，由用户点击继续访问
+	var continueURL string
+	if target, ok := crossDomainTarget(req.Redirect); ok {
+		if !breached {
+			return c.Redirect(ssoRedirect(target, token), fiber.StatusSeeOther)
+		}
+		// 授权码很快过期，点击继续时再由首页签发
+		continueURL = "/?r=" + url.QueryEscape(req.Redirect)
+	} else if len(req.Redirect) > 0 {
+		if isSafeRedirect(req.Redirect, rootDomain) {
+			if !breached {
+				return c.Redirect(req.Redirect, fiber.StatusSeeOther)
+			}
+			continueURL = req.Redirect
 		} else {
-			// 尝试解析 URL 获取 Hostname
-			var hostname string
-			u, err := url.Parse(req.Redirect)
-			if err == nil {
+			logrus.Warnf("Invalid redirect attempt to %s", req.Redirect)
+		}
+	}
+	return c.Render("index", fiber.Map{
+		"username":          user,
+		"expire":            expireAt.Unix(),
+		"admin":             isAdmin(user),
+		"password_breached": breached,
+		"continue_url":      continueURL,
+	})
+}
+
+// isSafeRedirect 检查登录后的跳转地址是否安全 (Open Redirect Protection)
+// 允许站内路径、与认证服务属于同一根域名的站点、trusted_domains 和内置反向代理的域名
+func isSafeRedirect(redirect, rootDomain string) bool {
+	safeRedirect := false
+	if strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") {
+		safeRedirect = true
+	} else {
+		// 尝试解析 URL 获取 Hostname
+		var hostname string
+		u, err := url.Parse(redirect)
+		if err == nil {
+			hostname = u.Hostname()
+		}
+		// 处理无协议头的 URL (如 //example.com)
+		if hostname == "" && strings.HasPrefix(redirect, "//") {
+			if u, err := url.Parse("https:" + redirect); err == nil {
 				hostname = u.Hostname()
 			}
-			// 处理无协议头的 URL (如 //example.com)
-			if hostname == "" && strings.HasPrefix(req.Redirect, "//") {
-				if u, err := url.Parse("https:" + req.Redirect); err == nil {
-					hostname = u.Hostname()
-				}
-			}
+		}
 
-			if hostname != "" {
-				// 1. 检查是否与认证服务属于同一根域名 (保持原有逻辑)
-				redirectRoot, err := utils.ExtractRootDomain(req.Redirect)
-				if err == nil && redirectRoot == rootDomain {
-					safeRedirect = true
-				}
+		if hostname != "" {
+			// 1. 检查是否与认证服务属于同一根域名 (保持原有逻辑)
+			redirectRoot, err := utils.ExtractRootDomain(redirect)
+			if err == nil && redirectRoot == rootDomain {
+				safeRedirect = true
+			}
 
-				// 2. 检查 TrustedDomains (支持子域名匹配)
-				if !safeRedirect {
-					for _, domain := range vars.Config.TrustedDomains {
-						// 允许完全相等 或 作为子域名 (e.g. "a.example.com" 匹配 "example.com")
-						if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
-							safeRedirect = true
-							break
-						}
+			// 2. 检查 TrustedDomains (支持子域名匹配)
+			if !safeRedirect {
+				for _, domain := range vars.Config().TrustedDomains {
+					// 允许完全相等 或 作为子域名 (e.g. "a.example.com" 匹配 "example.com")
+					if utils.MatchDomain(hostname, domain) {
+						safeRedirect = true
+						break
 					}
 				}
 			}
-		}
 
-		if safeRedirect {
-			return c.Redirect(req.Redirect, fiber.StatusSeeOther)
+			// 3. 内置反向代理的域名
+			if !safeRedirect {
+				_, safeRedirect = proxyRouteFor(hostname)
+			}
 		}
-		logrus.Warnf("Invalid redirect attempt to %s", req.Redirect)
 	}
-	return c.Render("index", fiber.Map{
-		"username": user,
-		"expire":   expireAt.Unix(),
-	})
+	return safeRedirect
 }
 
 func indexHandler(c *fiber.Ctx) error {
 	userinfo, ok := c.Locals(authUserKey).(authUserType)
 	if !ok { // 没有登录
-		return c.Render("login", fiber.Map{})
+		return c.Render("login", loginPageData(c.Query("r")))
+	}
+	// 已登录时访问其他根域名的站点，直接签发授权码跳转回去
+	if token := cookieToken(c); token != "" {
+		if target, ok := crossDomainTarget(c.Query("r")); ok {
+			return c.Redirect(ssoRedirect(target, token), fiber.StatusSeeOther)
+		}
 	}
 	return c.Render("index", fiber.Map{
-		"username": userinfo.Username,
-		"expire":   userinfo.Expire.Unix(),
+		"username":         userinfo.Username,
+		"expire":           userinfo.Expire.Unix(),
+		"admin":            isAdmin(userinfo.Username),
+		"password_changed": c.Query("pw") == "ok",
 	})
 }
 
+// durationOption 登录页的时长选项，Key 和 Count 用于生成本地化的文字
+type durationOption struct {
+	Seconds int
+	Key     string
+	Count   int
+}
+
+// loginPageData 按跳转目标域名的会话策略生成登录页的时长选项，登录前无法确定用户，用户级别的限制在登录时生效
+func loginPageData(redirect string) fiber.Map {
+	durations, def := loginDurations(sessionPolicyFor("", redirectHost(redirect)))
+	options := make([]durationOption, 0, len(durations))
+	for _, d := range durations {
+		key, count := durationLabel(d)
+		options = append(options, durationOption{Seconds: d, Key: key, Count: count})
+	}
+	return fiber.Map{
+		"durations":        options,
+		"default_duration": def,
+	}
+}
+
+// durationLabel 将秒数转换为能整除的最大单位，返回对应的翻译键和数量
+func durationLabel(seconds int) (string, int) {
+	units := []struct {
+		name    string
+		seconds int
+	}{
+		{"year", 365 * 86400},
+		{"day", 86400},
+		{"hour", 3600},
+	}
+	for _, u := range units {
+		if seconds%u.seconds == 0 {
+			return durationKey(u.name, seconds/u.seconds), seconds / u.seconds
+		}
+	}
+	return durationKey("minute", seconds/60), seconds / 60
+}
+
+func durationKey(unit string, count int) string {
+	if count == 1 {
+		return "login.duration." + unit
+	}
+	return "login.duration." + unit + "s"
+}
+
 func logoutHandler(c *fiber.Ctx) error {
-	rootDomain, err := utils.ExtractRootDomain(vars.Config.Redirect)
-	if err == nil {
-		c.Cookie(&fiber.Cookie{
-			Name:     "arkauthn",
-			Value:    "",
-			Expires:  time.Now().Add(-1 * time.Hour), // Set to past time
-			HTTPOnly: true,
-			Secure:   strings.HasPrefix(vars.Config.Redirect, "https") || c.Protocol() == "https",
-			SameSite: "Lax",
-			Domain:   "." + rootDomain,
-		})
-	} else {
-		// Fallback if domain extraction fails, though login would have failed too
-		c.ClearCookie("arkauthn")
+	if userinfo, ok := c.Locals(authUserKey).(authUserType); ok {
+		recordAudit(c, auditLogout, userinfo.Username, "")
+		// 吊销会话，使其他域名下的 Cookie 同时失效
+		if userinfo.SessionID != "" && vars.SessionStore != nil {
+			vars.SessionStore.Revoke(userinfo.SessionID)
+		}
 	}
+	clearAuthCookie(c)
 	return c.Render("logout", fiber.Map{})
 }
 
 func checkUser(username, password string) (string, bool) {
-	var foundUser *vars.UserItem
-	for _, u := range vars.Config.Users {
-		if u.Username == username {
-			// Create a copy to avoid referencing loop variable
-			user := u
-			foundUser = &user
-			break
+	foundUser, found := vars.UserStore.Get(username)
+	if found {
+		verify := utils.VerifyPassword
+		if shared, ok := vars.UserStore.(vars.SharedUserStoreIFace); ok && shared.RequireHashedPasswords() {
+			verify = utils.VerifyHashedPassword
 		}
-	}
-
-	if foundUser != nil {
-		if strings.HasPrefix(foundUser.Password, "$2a$") || strings.HasPrefix(foundUser.Password, "$2b$") || strings.HasPrefix(foundUser.Password, "$2y$") {
-			if bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(password)) == nil {
-				return foundUser.Username, true
-			}
-		} else if subtle.ConstantTimeCompare([]byte(password), []byte(foundUser.Password)) > 0 {
+		ok, err := verify(foundUser.Password, password)
+		if err != nil {
+			logrus.Errorf("Verify password for %s failed: %v", foundUser.Username, err)
+		} else if ok {
 			return foundUser.Username, true
 		}
 	} else {
-		// Timing attack protection: simulate a bcrypt comparison
-		bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		// Timing attack protection: simulate a password verification
+		utils.SimulateVerifyPassword(password)
 	}
 	return "", false
 }
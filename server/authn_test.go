@@ -0,0 +1,113 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"github.com/zjyl1994/arkauthn/infra/i18n"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"github.com/zjyl1994/arkauthn/web"
+	"github.com/zjyl1994/cap-go"
+)
+
+type testCap struct{}
+
+func (testCap) CreateChallenge(*cap.ChallengeParams) *cap.Challenge { return &cap.Challenge{} }
+func (testCap) RedeemChallenge(*cap.Solution) *cap.RedeemResponse   { return &cap.RedeemResponse{} }
+func (testCap) ValidateToken(string, bool) bool                     { return true }
+
+type testPwned map[string]bool
+
+func (p testPwned) IsPwned(password string) (bool, error) { return p[password], nil }
+
+// newTestViewsApp 创建使用内置页面模板的应用
+func newTestViewsApp(t *testing.T) *fiber.App {
+	t.Helper()
+	assets, err := web.GetHttpAssets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := html.NewFileSystem(assets, ".html")
+	engine.AddFunc("t", i18n.T)
+	engine.AddFunc("site", siteInfo)
+	return fiber.New(fiber.Config{
+		Immutable:         true,
+		Views:             engine,
+		ViewsLayout:       "layout",
+		PassLocalsToViews: true,
+	})
+}
+
+func TestLoginBreachedPasswordRedirect(t *testing.T) {
+	conf := testProxyConfig()
+	conf.PasswordHash.DisableRehash = true
+	conf.Users = append(conf.Users, vars.UserItem{Username: "bob", Password: "breached", Nonce: "n2"})
+	setupTestConfig(t, conf)
+	oldCap, oldPwned := vars.CapInstance, vars.PwnedPasswords
+	t.Cleanup(func() { vars.CapInstance, vars.PwnedPasswords = oldCap, oldPwned })
+	vars.CapInstance = testCap{}
+	vars.PwnedPasswords = testPwned{"breached": true}
+
+	app := newTestViewsApp(t)
+	app.Use(langMiddleware)
+	app.Post("/", loginAuthnHandler)
+
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		redirect     string
+		wantLocation string // 为空时渲染用户信息页
+		wantContinue string
+	}{
+		{"safe redirect", "alice", "x", "https://app.example.com/page", "https://app.example.com/page", ""},
+		{"breached without redirect", "bob", "breached", "", "", ""},
+		{"breached safe redirect", "bob", "breached", "https://app.example.com/page", "", "https://app.example.com/page"},
+		{"breached cross-domain redirect", "bob", "breached", "https://app.other.org/page", "", "/?r=" + url.QueryEscape("https://app.other.org/page")},
+		{"breached unsafe redirect", "bob", "breached", "https://evil.net/", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{
+				"username":  {tt.username},
+				"password":  {tt.password},
+				"redirect":  {tt.redirect},
+				"cap_token": {"x"},
+				"duration":  {"3600"},
+			}
+			req := httptest.NewRequest(fiber.MethodPost, "/", strings.NewReader(form.Encode()))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if tt.wantLocation != "" {
+				if resp.StatusCode != fiber.StatusSeeOther || resp.Header.Get(fiber.HeaderLocation) != tt.wantLocation {
+					t.Fatalf("status = %d, location = %q, want redirect to %q", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation), tt.wantLocation)
+				}
+				return
+			}
+			if resp.StatusCode != fiber.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			page := string(body)
+			if !strings.Contains(page, i18n.T(i18n.DefaultLang, "password.breached_warning")) {
+				t.Error("breached password warning not shown")
+			}
+			hasContinue := strings.Contains(page, i18n.T(i18n.DefaultLang, "password.breached_continue"))
+			if hasContinue != (tt.wantContinue != "") {
+				t.Errorf("continue link shown = %v, want %v", hasContinue, tt.wantContinue != "")
+			}
+			if tt.wantContinue != "" && !strings.Contains(page, `href="`+strings.ReplaceAll(tt.wantContinue, "&", "&amp;")+`"`) {
+				t.Errorf("continue link to %q not found in page", tt.wantContinue)
+			}
+		})
+	}
+}
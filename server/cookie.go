@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	defaultAuthCookieName = "arkauthn"
+	hostCookiePrefix      = "__Host-"
+	secureCookiePrefix    = "__Secure-"
+)
+
+func authCookieName() string {
+	if name := vars.Config().Cookie.Name; name != "" {
+		return name
+	}
+	return defaultAuthCookieName
+}
+
+// authCookieDomain 返回 Cookie 的 Domain 属性，为空表示只属于认证服务的域名
+func authCookieDomain() (string, error) {
+	if strings.HasPrefix(authCookieName(), hostCookiePrefix) {
+		return "", nil
+	}
+	if domain := vars.Config().Cookie.Domain; domain != "" {
+		return domain, nil
+	}
+	rootDomain, err := utils.ExtractRootDomain(vars.Config().Redirect)
+	if err != nil {
+		return "", err
+	}
+	return "." + rootDomain, nil
+}
+
+// cookieCoversHost 判断认证服务写入的 Cookie 是否会被浏览器发送到指定主机
+func cookieCoversHost(host string) bool {
+	domain, err := authCookieDomain()
+	if err != nil {
+		return false
+	}
+	if domain == "" {
+		u, err := url.Parse(vars.Config().Redirect)
+		return err == nil && strings.EqualFold(u.Hostname(), host)
+	}
+	return utils.MatchDomain(strings.ToLower(host), strings.ToLower(strings.TrimPrefix(domain, ".")))
+}
+
+func authCookiePath() string {
+	if p := vars.Config().Cookie.Path; p != "" && !strings.HasPrefix(authCookieName(), hostCookiePrefix) {
+		return p
+	}
+	return "/"
+}
+
+func authCookieSameSite() string {
+	if sameSite := vars.Config().Cookie.SameSite; sameSite != "" {
+		return sameSite
+	}
+	return fiber.CookieSameSiteLaxMode
+}
+
+// authCookieForceSecure 带前缀的 Cookie 和 SameSite=None 的 Cookie 必须设置 Secure，否则浏览器会拒绝
+func authCookieForceSecure() bool {
+	name := authCookieName()
+	return strings.HasPrefix(name, hostCookiePrefix) || strings.HasPrefix(name, secureCookiePrefix) ||
+		strings.EqualFold(authCookieSameSite(), fiber.CookieSameSiteNoneMode)
+}
+
+// newAuthCookie 按配置生成认证 Cookie
+// ForwardAuth 或内置代理请求的站点不在 Cookie 的域名范围内时（跨域登录），Cookie 只写入该站点的域名
+func newAuthCookie(c *fiber.Ctx, value string, expireAt time.Time) (*fiber.Cookie, error) {
+	domain, err := authCookieDomain()
+	if err != nil {
+		return nil, err
+	}
+	secure := strings.HasPrefix(vars.Config().Redirect, "https") || c.Protocol() == "https"
+	if v := vars.Config().Cookie.Secure; v != nil {
+		secure = *v
+	}
+	if host, ok := c.Locals(proxyHostKey).(string); ok {
+		if !cookieCoversHost(host) {
+			domain = ""
+			secure = c.Protocol() == "https"
+		}
+	} else if host := forwardedHostname(c); host != "" && !cookieCoversHost(host) {
+		domain = ""
+		secure = c.Get("X-Forwarded-Proto") == "https"
+	}
+	return &fiber.Cookie{
+		Name:     authCookieName(),
+		Value:    value,
+		Path:     authCookiePath(),
+		Domain:   domain,
+		Expires:  expireAt,
+		HTTPOnly: true,
+		Secure:   secure || authCookieForceSecure(),
+		SameSite: authCookieSameSite(),
+	}, nil
+}
+
+// setAuthCookie 将令牌写入 Cookie，返回认证服务的根域名
+func setAuthCookie(c *fiber.Ctx, token string, expireAt time.Time) (string, error) {
+	rootDomain, err := utils.ExtractRootDomain(vars.Config().Redirect)
+	if err != nil {
+		return "", err
+	}
+	cookie, err := newAuthCookie(c, token, expireAt)
+	if err != nil {
+		return "", err
+	}
+	c.Cookie(cookie)
+	return rootDomain, nil
+}
+
+// clearAuthCookie 删除认证 Cookie，属性需要与写入时一致浏览器才会删除
+func clearAuthCookie(c *fiber.Ctx) {
+	cookie, err := newAuthCookie(c, "", time.Now().Add(-1*time.Hour))
+	if err != nil {
+		// Fallback if domain extraction fails, though login would have failed too
+		c.ClearCookie(authCookieName())
+		return
+	}
+	c.Cookie(cookie)
+}
+
+// forwardedHostname 返回 X-Forwarded-Host 中的主机名，不含端口
+func forwardedHostname(c *fiber.Ctx) string {
+	host := c.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// setupTestConfig 使用测试配置，测试结束后恢复原有的全局状态
+func setupTestConfig(t *testing.T, conf vars.ConfigFile) {
+	t.Helper()
+	oldConfig, oldUserStore := *vars.Config(), vars.UserStore
+	t.Cleanup(func() {
+		vars.SetConfig(oldConfig)
+		vars.UserStore = oldUserStore
+	})
+	vars.SetConfig(conf)
+	vars.UserStore = utils.NewConfigUserStore()
+}
+
+func testProxyConfig() vars.ConfigFile {
+	return vars.ConfigFile{
+		Redirect:    "https://auth.example.com",
+		Secret:      "test-secret-test-secret-test-secret",
+		Users:       []vars.UserItem{{Username: "alice", Password: "x", Nonce: "n1"}},
+		CrossDomain: vars.CrossDomain{Enabled: true},
+		Proxy: vars.ProxyConfig{Routes: []vars.ProxyRoute{
+			{Host: "app.other.org", Upstream: "http://127.0.0.1:1"},
+			{Host: "app.example.com", Upstream: "http://127.0.0.1:1"},
+		}},
+	}
+}
+
+// addTestSSOCode 为 alice 签发令牌并登记发往 host 的一次性授权码
+func addTestSSOCode(t *testing.T, host string) string {
+	t.Helper()
+	token, err := utils.GenerateToken("alice", "s1", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := "code-" + host
+	ssoCodes.Lock()
+	ssoCodes.m[code] = ssoCode{token: token, host: host, redirect: "https://" + host + "/", expiresAt: time.Now().Add(time.Minute)}
+	ssoCodes.Unlock()
+	return code
+}
+
+func TestProxySSOCallbackCookieDomain(t *testing.T) {
+	setupTestConfig(t, testProxyConfig())
+	app := fiber.New()
+	app.Use(proxyMiddleware)
+
+	const host = "app.other.org"
+	code := addTestSSOCode(t, host)
+	// 直接访问内置代理，没有 X-Forwarded-Host
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+ssoCallbackPath()+"?code="+code, nil)
+	req.RequestURI = ""
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != authCookieName() {
+		t.Fatalf("cookies = %v, want one %s cookie", cookies, authCookieName())
+	}
+	// 不在 Cookie 域名范围内的站点只写入该站点自己的域名，否则浏览器不会保存，Secure 取决于该站点的协议
+	if cookies[0].Domain != "" {
+		t.Errorf("cookie domain = %q, want host-only cookie", cookies[0].Domain)
+	}
+	if cookies[0].Secure {
+		t.Error("cookie is Secure for http request")
+	}
+}
+
+func TestForwardAuthCookieDomain(t *testing.T) {
+	setupTestConfig(t, testProxyConfig())
+	tests := []struct {
+		forwardedHost string
+		wantDomain    string
+	}{
+		{"", ".example.com"},
+		{"app.example.com", ".example.com"},
+		{"app.other.org:8443", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.forwardedHost, func(t *testing.T) {
+			app := fiber.New()
+			var cookie *fiber.Cookie
+			app.Get("/", func(c *fiber.Ctx) error {
+				var err error
+				cookie, err = newAuthCookie(c, "v", time.Now().Add(time.Hour))
+				return err
+			})
+			req := httptest.NewRequest(http.MethodGet, "http://auth.example.com/", nil)
+			if tt.forwardedHost != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+			}
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+			if cookie == nil || cookie.Domain != tt.wantDomain {
+				t.Errorf("cookie = %+v, want domain %q", cookie, tt.wantDomain)
+			}
+		})
+	}
+}
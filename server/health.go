@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	readinessMu     sync.RWMutex
+	readinessChecks = []readinessCheck{
+		{name: "config", check: checkConfigLoaded},
+		{name: "signing_keys", check: utils.CheckSigningKeys},
+	}
+)
+
+// RegisterReadinessCheck 注册就绪检查项，所有检查通过时 /readyz 返回 200
+func RegisterReadinessCheck(name string, check func() error) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessChecks = append(readinessChecks, readinessCheck{name: name, check: check})
+}
+
+func checkConfigLoaded() error {
+	if vars.Config().Hash == "" {
+		return errors.New("config not loaded")
+	}
+	return nil
+}
+
+// healthzHandler 存活检查，进程能处理请求即返回成功
+func healthzHandler(c *fiber.Ctx) error {
+	return c.SendString("ok")
+}
+
+// healthDetailAllowed 检查详情和配置哈希只返回给受信任的代理和携带管理接口密钥的请求
+func healthDetailAllowed(c *fiber.Ctx) bool {
+	if len(vars.Config().TrustedProxies) > 0 && c.IsProxyTrusted() {
+		return true
+	}
+	_, ok := lookupAPIKey(c)
+	return ok
+}
+
+// readyzHandler 就绪检查，返回是否就绪，有权限时返回各检查项结果
+func readyzHandler(c *fiber.Ctx) error {
+	readinessMu.RLock()
+	checks := readinessChecks
+	readinessMu.RUnlock()
+
+	ready := true
+	results := make(map[string]string, len(checks))
+	for _, item := range checks {
+		if err := item.check(); err != nil {
+			ready = false
+			results[item.name] = err.Error()
+		} else {
+			results[item.name] = "ok"
+		}
+	}
+	status := fiber.StatusOK
+	if !ready {
+		status = fiber.StatusServiceUnavailable
+	}
+	resp := fiber.Map{"ready": ready}
+	if healthDetailAllowed(c) {
+		resp["checks"] = results
+	}
+	return c.Status(status).JSON(resp)
+}
+
+func versionHandler(c *fiber.Ctx) error {
+	resp := fiber.Map{
+		"version":    vars.Version,
+		"commit":     vars.Commit,
+		"go_version": runtime.Version(),
+	}
+	if healthDetailAllowed(c) {
+		resp["config_hash"] = vars.Config().Hash
+	}
+	return c.JSON(resp)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func TestHealthDetails(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		apiKey         string
+		wantDetail     bool
+	}{
+		{name: "anonymous"},
+		{name: "invalid api key", apiKey: "wrong"},
+		{name: "admin api key", apiKey: "test-api-key", wantDetail: true},
+		{name: "trusted proxy", trustedProxies: []string{"0.0.0.0"}, wantDetail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testProxyConfig()
+			conf.TrustedProxies = tt.trustedProxies
+			conf.AdminAPI.Keys = []vars.APIKeyItem{{Name: "ci", Key: "test-api-key"}}
+			conf.Hash = "test-hash"
+			setupTestConfig(t, conf)
+
+			app := fiber.New(fiber.Config{
+				EnableTrustedProxyCheck: len(tt.trustedProxies) > 0,
+				TrustedProxies:          tt.trustedProxies,
+			})
+			app.Get("/readyz", readyzHandler)
+			app.Get("/version", versionHandler)
+			for path, field := range map[string]string{"/readyz": "checks", "/version": "config_hash"} {
+				req := httptest.NewRequest(fiber.MethodGet, path, nil)
+				if tt.apiKey != "" {
+					req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tt.apiKey)
+				}
+				resp, err := app.Test(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var body map[string]any
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if _, ok := body[field]; ok != tt.wantDetail {
+					t.Errorf("%s returned %s = %v, want %v", path, field, ok, tt.wantDetail)
+				}
+			}
+		})
+	}
+}
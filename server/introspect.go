@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// introspectHandler RFC 7662 令牌检查
+// 客户端凭据通过 HTTP Basic 或表单中的 client_id、client_secret 传递，令牌无效时只返回 {"active": false}
+func introspectHandler(c *fiber.Ctx) error {
+	if len(vars.Config().Introspection.Clients) == 0 {
+		return c.SendStatus(http.StatusNotFound)
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	ipAddr := c.IP()
+	if vars.AuthRateLimiter != nil && vars.AuthRateLimiter.IsLimited(ipAddr) {
+		return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{"error": "too_many_requests"})
+	}
+	clientID, ok := introspectionClient(c)
+	if !ok {
+		if vars.AuthRateLimiter != nil {
+			vars.AuthRateLimiter.RecordError(ipAddr)
+		}
+		logrus.Warnf("Invalid introspection client from %s", ipAddr)
+		c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="arkauthn"`)
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "invalid_client"})
+	}
+	token := c.FormValue("token")
+	if token == "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "invalid_request"})
+	}
+	claims, err := utils.ParseToken(token)
+	if err != nil || isSessionRevoked(claims.ID) {
+		logrus.Debugf("Introspection by %s: inactive token", clientID)
+		return c.JSON(fiber.Map{"active": false})
+	}
+	u, ok := vars.UserStore.Get(claims.Username)
+	if !ok {
+		return c.JSON(fiber.Map{"active": false})
+	}
+	groups := u.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	result := fiber.Map{
+		"active":     true,
+		"client_id":  clientID,
+		"username":   claims.Username,
+		"sub":        claims.Username,
+		"groups":     groups,
+		"admin":      isAdmin(claims.Username),
+		"exp":        claims.ExpiresAt.Unix(),
+		"jti":        claims.ID,
+		"session_id": claims.ID,
+		"token_type": "Bearer",
+	}
+	if claims.IssuedAt != nil {
+		result["iat"] = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		result["nbf"] = claims.NotBefore.Unix()
+	}
+	if claims.AuthTime != nil {
+		result["auth_time"] = claims.AuthTime.Unix()
+	}
+	if claims.MaxExpiresAt != nil {
+		result["max_exp"] = claims.MaxExpiresAt.Unix()
+	}
+	logrus.Debugf("Introspection by %s: active token of %s", clientID, claims.Username)
+	return c.JSON(result)
+}
+
+// introspectionClient 校验客户端凭据，返回 client_id
+func introspectionClient(c *fiber.Ctx) (string, bool) {
+	clientID, secret, ok := basicAuth(c.Get(fiber.HeaderAuthorization))
+	if !ok {
+		clientID, secret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+	if clientID == "" || secret == "" {
+		return "", false
+	}
+	for _, cl := range vars.Config().Introspection.Clients {
+		if cl.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(clientID), []byte(cl.ClientID)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(secret), []byte(cl.ClientSecret)) == 1 {
+			return cl.ClientID, true
+		}
+	}
+	return "", false
+}
+
+// basicAuth 解析 HTTP Basic 凭据，按 RFC 6749 客户端 ID 和密钥需要先进行表单编码
+func basicAuth(header string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	id, err = url.QueryUnescape(id)
+	if err != nil {
+		return "", "", false
+	}
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
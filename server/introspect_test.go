@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// testLimiter 记录每个 IP 的失败次数，达到 limit 后限制
+type testLimiter struct {
+	limit  int
+	errors map[string]int
+}
+
+func (l *testLimiter) IsLimited(ip string) bool { return l.errors[ip] >= l.limit }
+func (l *testLimiter) RecordError(ip string)    { l.errors[ip]++ }
+func (l *testLimiter) Jailed() []vars.JailedIP  { return nil }
+func (l *testLimiter) Unban(ip string)          { delete(l.errors, ip) }
+
+// setupIntrospection 配置检查接口的客户端，密钥包含需要表单编码的字符
+func setupIntrospection(t *testing.T) (*fiber.App, *testLimiter) {
+	t.Helper()
+	conf := testProxyConfig()
+	conf.Introspection.Clients = []vars.IntrospectionClient{{ClientID: "backend", ClientSecret: "s3cret:+/ "}}
+	setupTestConfig(t, conf)
+	limiter := &testLimiter{limit: 3, errors: make(map[string]int)}
+	oldLimiter, oldSessionStore := vars.AuthRateLimiter, vars.SessionStore
+	t.Cleanup(func() {
+		vars.AuthRateLimiter = oldLimiter
+		vars.SessionStore = oldSessionStore
+	})
+	vars.AuthRateLimiter = limiter
+	vars.SessionStore = utils.NewMemorySessionStore()
+
+	app := fiber.New()
+	app.Post("/api/introspect", introspectHandler)
+	return app, limiter
+}
+
+func introspect(t *testing.T, app *fiber.App, form url.Values, authorization string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodPost, "/api/introspect", strings.NewReader(form.Encode()))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	if authorization != "" {
+		req.Header.Set(fiber.HeaderAuthorization, authorization)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func basicAuthHeader(id, secret string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(url.QueryEscape(id)+":"+url.QueryEscape(secret)))
+}
+
+func TestIntrospectClientCredentials(t *testing.T) {
+	app, _ := setupIntrospection(t)
+	token, err := utils.GenerateToken("alice", "s1", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		form          url.Values
+		authorization string
+		wantStatus    int
+	}{
+		{"basic", url.Values{}, basicAuthHeader("backend", "s3cret:+/ "), fiber.StatusOK},
+		{"form", url.Values{"client_id": {"backend"}, "client_secret": {"s3cret:+/ "}}, "", fiber.StatusOK},
+		// Basic 凭据需要先进行表单编码，未编码时空格和 + 无法区分
+		{"basic not form-encoded", url.Values{}, "Basic " + base64.StdEncoding.EncodeToString([]byte("backend:s3cret:+/ ")), fiber.StatusUnauthorized},
+		{"basic wrong secret", url.Values{}, basicAuthHeader("backend", "wrong"), fiber.StatusUnauthorized},
+		{"form wrong client", url.Values{"client_id": {"other"}, "client_secret": {"s3cret:+/ "}}, "", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("token", token)
+			status, body := introspect(t, app, tt.form, tt.authorization)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %v", status, tt.wantStatus, body)
+			}
+			if status == fiber.StatusOK && (body["active"] != true || body["client_id"] != "backend" || body["username"] != "alice") {
+				t.Errorf("body = %v", body)
+			}
+			if status == fiber.StatusUnauthorized && body["error"] != "invalid_client" {
+				t.Errorf("body = %v", body)
+			}
+		})
+	}
+}
+
+// 错误的客户端密钥计入登录失败次数，达到上限后返回 429
+func TestIntrospectRateLimit(t *testing.T) {
+	app, limiter := setupIntrospection(t)
+	form := url.Values{"token": {"x"}, "client_id": {"backend"}, "client_secret": {"wrong"}}
+	for i := range limiter.limit {
+		if status, _ := introspect(t, app, form, ""); status != fiber.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i, status)
+		}
+	}
+	if got := limiter.errors["0.0.0.0"]; got != limiter.limit {
+		t.Errorf("recorded errors = %d, want %d", got, limiter.limit)
+	}
+	form.Set("client_secret", "s3cret:+/ ")
+	if status, _ := introspect(t, app, form, ""); status != fiber.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", status)
+	}
+}
+
+func TestIntrospectInactiveTokens(t *testing.T) {
+	app, limiter := setupIntrospection(t)
+	expired, err := utils.GenerateToken("alice", "s-expired", -time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := utils.GenerateToken("alice", "s-revoked", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars.SessionStore.Create(vars.Session{ID: "s-revoked", Username: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	vars.SessionStore.Revoke("s-revoked")
+
+	for name, token := range map[string]string{"expired": expired, "revoked": revoked, "malformed": "not-a-jwt"} {
+		t.Run(name, func(t *testing.T) {
+			form := url.Values{"token": {token}, "client_id": {"backend"}, "client_secret": {"s3cret:+/ "}}
+			status, body := introspect(t, app, form, "")
+			if status != fiber.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			if len(body) != 1 || body["active"] != false {
+				t.Errorf("body = %v, want only active=false", body)
+			}
+		})
+	}
+	if len(limiter.errors) != 0 {
+		t.Errorf("inactive tokens counted as client errors: %v", limiter.errors)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	unixListenPrefix   = "unix:"
+	defaultSocketMode  = 0660
+	watchdogMinimumGap = time.Second
+	// 平滑重启时旧进程仍占用管理接口和 ACME HTTP 端口，新进程需要等待其退出
+	bindRetry         = 60
+	bindRetryInterval = time.Second
+)
+
+// newListener 创建监听器，优先使用 systemd socket activation 或平滑重启传入的监听器
+// listen 支持 host:port 和 unix:/path/to/socket 两种格式
+func newListener(listen string) (net.Listener, error) {
+	inherited, err := utils.InheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(inherited) > 0 {
+		for _, ln := range inherited[1:] {
+			ln.Close()
+		}
+		logrus.Infoln("Using inherited listener", inherited[0].Addr())
+		return inherited[0], nil
+	}
+
+	socketPath, isUnix := strings.CutPrefix(listen, unixListenPrefix)
+	if !isUnix {
+		return net.Listen("tcp", listen)
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(defaultSocketMode)
+	if vars.Config().ListenMode != "" {
+		m, err := strconv.ParseUint(vars.Config().ListenMode, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		mode = os.FileMode(m)
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenWithRetry 监听 TCP 地址，端口被占用时重试，用于不随平滑重启传递的辅助监听器
+func listenWithRetry(listen string) (net.Listener, error) {
+	var err error
+	for i := 0; i < bindRetry; i++ {
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", listen); err == nil {
+			return ln, nil
+		}
+		time.Sleep(bindRetryInterval)
+	}
+	return nil, err
+}
+
+// removeStaleSocket 清理上次异常退出残留的 socket 文件
+// 只有连接被拒绝（没有进程在监听）时才删除，避免删掉另一个正在运行的实例的 socket
+func removeStaleSocket(socketPath string) error {
+	st, err := os.Lstat(socketPath)
+	if err != nil || st.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", socketPath)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(socketPath)
+}
+
+// notifySystemdReady 通知 systemd 服务已就绪，并按要求定期发送看门狗心跳
+func notifySystemdReady() {
+	ok, err := utils.SdNotify("READY=1")
+	if err != nil {
+		logrus.Warnf("sd_notify READY failed: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	interval := utils.SdWatchdogInterval() / 2
+	if interval <= 0 {
+		return
+	}
+	if interval < watchdogMinimumGap {
+		interval = watchdogMinimumGap
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := utils.SdNotify("WATCHDOG=1"); err != nil {
+				logrus.Warnf("sd_notify WATCHDOG failed: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, path string)
+		wantErr    bool
+		wantExists bool
+	}{
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.(*net.UnixListener).SetUnlinkOnClose(false)
+				ln.Close()
+			},
+		},
+		{
+			name: "socket in use",
+			setup: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+			},
+			wantErr:    true,
+			wantExists: true,
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantExists: true,
+		},
+		{
+			name:  "not exist",
+			setup: func(t *testing.T, path string) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arkauthn.sock")
+			tt.setup(t, path)
+			if err := removeStaleSocket(path); (err != nil) != tt.wantErr {
+				t.Fatalf("removeStaleSocket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Lstat(path); (err == nil) != tt.wantExists {
+				t.Errorf("socket file exists = %v, want %v", err == nil, tt.wantExists)
+			}
+		})
+	}
+}
@@ -1,30 +1,120 @@
 package server
 
 import (
+	"io"
+	"net/http"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/samber/lo"
+	"github.com/zjyl1994/arkauthn/infra/i18n"
 	"github.com/zjyl1994/arkauthn/infra/utils"
 )
 
 type authUserType struct {
-	Username string
-	Expire   time.Time
+	Username  string
+	Expire    time.Time
+	MaxExpire time.Time // 滑动续期的最长有效期，不续期的令牌为空
+	SessionID string
 }
 
 var authUserKey authUserType
 
 func authTokenMiddleware(c *fiber.Ctx) error {
-	token, ok := lo.Coalesce(c.Cookies("arkauthn"), c.Get("X-Arkauthn"))
-	if ok {
-		username, expire, err := utils.ParseToken(token)
-		if err == nil {
-			c.Locals(authUserKey, authUserType{
-				Username: username,
-				Expire:   expire,
-			})
+	if userinfo, ok := authenticate(c); ok {
+		c.Locals(authUserKey, userinfo)
+	}
+	return c.Next()
+}
+
+// requestToken 返回 Cookie 或 X-Arkauthn 请求头中的令牌，Cookie 中的令牌可以续期
+func requestToken(c *fiber.Ctx) (token string, fromCookie bool) {
+	if cookieToken := c.Cookies(authCookieName()); cookieToken != "" {
+		return cookieToken, true
+	}
+	return c.Get("X-Arkauthn"), false
+}
+
+// authenticate 校验请求中的令牌，滑动续期的令牌会同时续期
+func authenticate(c *fiber.Ctx) (authUserType, bool) {
+	token, fromCookie := requestToken(c)
+	if token == "" {
+		return authUserType{}, false
+	}
+	claims, err := utils.ParseToken(token)
+	if err != nil || isSessionRevoked(claims.ID) {
+		return authUserType{}, false
+	}
+	userinfo := authUserType{
+		Username:  claims.Username,
+		Expire:    claims.ExpiresAt.Time,
+		SessionID: claims.ID,
+	}
+	if claims.MaxExpiresAt != nil {
+		userinfo.MaxExpire = claims.MaxExpiresAt.Time
+		// 只有 Cookie 中的令牌可以续期
+		if fromCookie {
+			userinfo.Expire = renewSession(c, claims)
 		}
 	}
+	return userinfo, true
+}
+
+// bodyLimitMiddleware 将认证服务自身路由的请求体读入内存，超过 fiber.DefaultBodyLimit 时返回 413
+// 开启 StreamRequestBody 后 fasthttp 不再拒绝过大的请求体，只有反向代理的请求以流的方式转发
+func bodyLimitMiddleware(c *fiber.Ctx) error {
+	req := c.Request()
+	if req.Header.ContentLength() > fiber.DefaultBodyLimit {
+		c.Response().SetConnectionClose()
+		return c.SendStatus(http.StatusRequestEntityTooLarge)
+	}
+	stream := c.Context().RequestBodyStream()
+	if stream == nil || req.Header.ContentLength() == 0 {
+		return c.Next()
+	}
+	body, err := io.ReadAll(io.LimitReader(stream, fiber.DefaultBodyLimit+1))
+	if err != nil {
+		c.Response().SetConnectionClose()
+		return c.SendStatus(http.StatusBadRequest)
+	}
+	if len(body) > fiber.DefaultBodyLimit {
+		c.Response().SetConnectionClose()
+		return c.SendStatus(http.StatusRequestEntityTooLarge)
+	}
+	req.SetBody(body)
+	return c.Next()
+}
+
+const langCookieName = "arkauthn_lang"
+
+// langMiddleware 按 查询参数 > Cookie > Accept-Language 的顺序确定界面语言
+// 通过查询参数切换语言时会写入 Cookie，后续访问保持一致
+func langMiddleware(c *fiber.Ctx) error {
+	lang := i18n.Match(c.Query("lang"))
+	if lang != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     langCookieName,
+			Value:    lang,
+			Expires:  time.Now().AddDate(1, 0, 0),
+			HTTPOnly: true,
+			SameSite: "Lax",
+		})
+	} else {
+		lang = i18n.Match(c.Cookies(langCookieName))
+	}
+	if lang == "" {
+		lang = i18n.Match(i18n.ParseAcceptLanguage(c.Get(fiber.HeaderAcceptLanguage))...)
+	}
+	if lang == "" {
+		lang = i18n.DefaultLang
+	}
+	c.Locals(langKey, lang)
 	return c.Next()
 }
+
+// renderError 渲染翻译后的错误页面
+func renderError(c *fiber.Ctx, status int, key string) error {
+	lang, _ := c.Locals(langKey).(string)
+	return c.Status(status).Render("error", fiber.Map{
+		"message": i18n.T(lang, key),
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/i18n"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	auditPasswordChange   = "password_change"
+	auditBreachedPassword = "breached_password"
+)
+
+// upgradePasswordHash 登录成功后将明文、旧格式或参数过低的密码哈希升级为配置的算法
+// 只读的用户文件不升级，与其他服务共用的用户文件升级为对方能识别的算法
+func upgradePasswordHash(username, password string) {
+	if vars.Config().PasswordHash.DisableRehash {
+		return
+	}
+	var algorithm string
+	if shared, ok := vars.UserStore.(vars.SharedUserStoreIFace); ok {
+		if shared.ReadOnly() {
+			return
+		}
+		algorithm = shared.PasswordHashAlgorithm()
+	}
+	u, ok := vars.UserStore.Get(username)
+	if !ok || !utils.PasswordNeedsRehashTo(algorithm, u.Password) {
+		return
+	}
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		hash, err := utils.HashPasswordWith(algorithm, password)
+		if err != nil {
+			return nil, err
+		}
+		users[idx].Password = hash
+		return users, nil
+	})
+	if err != nil {
+		logrus.Errorf("Rehash password for %s failed: %v", username, err)
+		return
+	}
+	logrus.Infof("Password hash of %s upgraded", username)
+}
+
+// hashUserPassword 生成保存到用户数据来源的密码哈希，与其他服务共用的用户文件使用对方能识别的算法
+func hashUserPassword(password string) (string, error) {
+	if shared, ok := vars.UserStore.(vars.SharedUserStoreIFace); ok {
+		return utils.HashPasswordWith(shared.PasswordHashAlgorithm(), password)
+	}
+	return utils.HashPassword(password)
+}
+
+// isBreachedPassword 检查密码是否出现在泄露密码库中，未配置时返回 false
+func isBreachedPassword(password string) bool {
+	if vars.PwnedPasswords == nil {
+		return false
+	}
+	pwned, err := vars.PwnedPasswords.IsPwned(password)
+	if err != nil {
+		logrus.Errorf("Check breached password failed: %v", err)
+		return false
+	}
+	return pwned
+}
+
+// changePasswordHandler 用户自助修改密码
+// 修改成功后更换 Nonce 使其他会话失效，并为当前会话重新签发令牌
+func changePasswordHandler(c *fiber.Ctx) error {
+	userinfo, ok := c.Locals(authUserKey).(authUserType)
+	if !ok {
+		return c.Redirect("/", fiber.StatusSeeOther)
+	}
+	var req struct {
+		Current string `form:"current_password"`
+		New     string `form:"new_password"`
+		Confirm string `form:"confirm_password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return err
+	}
+
+	ipAddr := c.IP()
+	if vars.AuthRateLimiter != nil && vars.AuthRateLimiter.IsLimited(ipAddr) {
+		logrus.Warnf("Too many password change attempts %s", ipAddr)
+		return renderError(c, http.StatusTooManyRequests, "error.too_many_attempts")
+	}
+	if _, ok := checkUser(userinfo.Username, req.Current); !ok {
+		if vars.AuthRateLimiter != nil {
+			vars.AuthRateLimiter.RecordError(ipAddr)
+		}
+		logrus.Warnf("Invalid password change attempt %s", ipAddr)
+		recordAudit(c, auditPasswordChange, userinfo.Username, "invalid current password")
+		return renderPasswordError(c, userinfo, &utils.PasswordPolicyError{Key: "password.error.invalid_current"})
+	}
+	if req.New != req.Confirm {
+		return renderPasswordError(c, userinfo, &utils.PasswordPolicyError{Key: "password.error.mismatch"})
+	}
+	if err := utils.CheckPasswordPolicy(userinfo.Username, req.New); err != nil {
+		return renderPasswordError(c, userinfo, err)
+	}
+
+	err := updateUsers(func(users []vars.UserItem) ([]vars.UserItem, error) {
+		idx := findUser(users, userinfo.Username)
+		if idx < 0 {
+			return nil, adminError("admin.error.user_not_found")
+		}
+		hash, err := hashUserPassword(req.New)
+		if err != nil {
+			return nil, err
+		}
+		users[idx].Password = hash
+		users[idx].Nonce = utils.RandString(16)
+		return users, nil
+	})
+	if key, ok := err.(adminError); ok {
+		return renderPasswordError(c, userinfo, &utils.PasswordPolicyError{Key: string(key)})
+	}
+	if err != nil {
+		logrus.Errorf("Change password for %s failed: %v", userinfo.Username, err)
+		return renderPasswordError(c, userinfo, &utils.PasswordPolicyError{Key: "password.error.save_failed"})
+	}
+	if vars.SessionStore != nil {
+		vars.SessionStore.RevokeUser(userinfo.Username)
+	}
+	recordAudit(c, auditPasswordChange, userinfo.Username, "success")
+
+	// 保持原会话剩余的有效期，滑动续期的会话使用剩余的最长有效期
+	remaining := time.Until(userinfo.Expire)
+	if !userinfo.MaxExpire.IsZero() {
+		remaining = time.Until(userinfo.MaxExpire)
+	}
+	token, expireAt, err := issueSession(c, userinfo.Username, "", remaining)
+	if err != nil {
+		return err
+	}
+	if _, err := setAuthCookie(c, token, expireAt); err != nil {
+		return err
+	}
+	return c.Redirect("/?pw=ok", fiber.StatusSeeOther)
+}
+
+func renderPasswordError(c *fiber.Ctx, userinfo authUserType, err error) error {
+	lang, _ := c.Locals(langKey).(string)
+	message := err.Error()
+	var policyErr *utils.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		message = i18n.T(lang, policyErr.Key, policyErr.Args...)
+	}
+	return c.Status(http.StatusBadRequest).Render("index", fiber.Map{
+		"username":       userinfo.Username,
+		"expire":         userinfo.Expire.Unix(),
+		"admin":          isAdmin(userinfo.Username),
+		"password_error": message,
+	})
+}
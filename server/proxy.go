@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// hopHeaders 只在单个连接上有效的请求头，不转发给上游和客户端
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// identityHeaders 由认证服务设置的用户信息请求头，客户端传入的同名请求头会被删除
+var identityHeaders = []string{"Remote-User", "Remote-Groups", "X-Forwarded-User"}
+
+var proxyTransport = newProxyTransport()
+
+func newProxyTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	// 原样转发 Accept-Encoding 和压缩后的响应
+	t.DisableCompression = true
+	t.MaxIdleConnsPerHost = 32
+	return t
+}
+
+// proxyBodyLimit 返回代理请求体大小上限，0 表示不限制
+func proxyBodyLimit() int64 {
+	return int64(vars.Config().Proxy.BodyLimit) * 1024 * 1024
+}
+
+// proxyRouteFor 返回域名对应的反向代理路由
+func proxyRouteFor(host string) (vars.ProxyRoute, bool) {
+	for _, route := range vars.Config().Proxy.Routes {
+		if strings.EqualFold(route.Host, host) {
+			return route, true
+		}
+	}
+	return vars.ProxyRoute{}, false
+}
+
+// proxyMiddleware 内置反向代理，请求的域名匹配 proxy.routes 时校验登录状态并转发到上游
+// 其他域名的请求交给认证服务自身处理，代理的响应不添加认证服务的安全响应头
+func proxyMiddleware(c *fiber.Ctx) error {
+	host := c.Hostname()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	route, ok := proxyRouteFor(host)
+	if !ok {
+		return c.Next()
+	}
+	// 直接访问内置代理的请求没有 X-Forwarded-Host，写入 Cookie 时以此判断请求的站点
+	c.Locals(proxyHostKey, strings.ToLower(host))
+	requestURL := c.BaseURL() + c.OriginalURL()
+	if vars.Config().CrossDomain.Enabled && c.Path() == ssoCallbackPath() {
+		u, err := url.Parse(requestURL)
+		if err != nil {
+			return c.SendStatus(http.StatusBadRequest)
+		}
+		return ssoCallback(c, u)
+	}
+	userinfo, ok := cachedAuthenticate(c, host)
+	if !ok {
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			return redirectToLogin(c, requestURL)
+		}
+		return c.SendStatus(http.StatusUnauthorized)
+	}
+
+	if limit := proxyBodyLimit(); limit > 0 && int64(c.Request().Header.ContentLength()) > limit {
+		c.Response().SetConnectionClose()
+		return c.SendStatus(http.StatusRequestEntityTooLarge)
+	}
+	body := newProxyRequestBody(c)
+	// 上游没有读完请求体时关闭客户端连接，剩余的请求体不能被当作下一个请求
+	defer func() {
+		if !body.finish() {
+			c.Response().SetConnectionClose()
+		}
+	}()
+	req, err := newUpstreamRequest(c, route, userinfo, body)
+	if err != nil {
+		logrus.Errorf("Invalid upstream %s for %s: %v", route.Upstream, route.Host, err)
+		return c.SendStatus(http.StatusBadGateway)
+	}
+	logrus.Debugf("Proxy %s %s to %s for user:%s", c.Method(), requestURL, req.URL, userinfo.Username)
+	if isWebSocketUpgrade(c) {
+		return proxyWebSocket(c, req)
+	}
+	resp, err := proxyTransport.RoundTrip(req)
+	if err != nil {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			return c.SendStatus(http.StatusRequestEntityTooLarge)
+		}
+		logrus.Errorf("Proxy to %s failed: %v", req.URL, err)
+		return c.SendStatus(http.StatusBadGateway)
+	}
+	copyUpstreamResponse(c, resp)
+	return nil
+}
+
+// proxyRequestBody 转发给上游的请求体，边读取客户端连接边发送，不在内存中缓存完整的请求体
+type proxyRequestBody struct {
+	mu     sync.Mutex
+	r      io.Reader
+	eof    bool
+	closed bool
+}
+
+// newProxyRequestBody 返回客户端请求体的流，超过 body_limit 时读取出错
+func newProxyRequestBody(c *fiber.Ctx) *proxyRequestBody {
+	var r io.Reader = c.Context().RequestBodyStream()
+	if r == nil {
+		r = http.NoBody
+	}
+	if limit := proxyBodyLimit(); limit > 0 {
+		r = http.MaxBytesReader(nil, io.NopCloser(r), limit)
+	}
+	return &proxyRequestBody{r: r, eof: c.Request().Header.ContentLength() == 0}
+}
+
+func (b *proxyRequestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *proxyRequestBody) Close() error {
+	b.finish()
+	return nil
+}
+
+// finish 停止读取请求体，返回请求体是否已经读完
+// 请求处理结束后 fasthttp 会复用连接的读缓冲区，之后上游的发送协程不能再读取
+func (b *proxyRequestBody) finish() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.eof
+}
+
+// newUpstreamRequest 创建发往上游的请求，去掉认证令牌并设置用户信息请求头
+func newUpstreamRequest(c *fiber.Ctx, route vars.ProxyRoute, userinfo authUserType, body *proxyRequestBody) (*http.Request, error) {
+	target, err := url.Parse(strings.TrimSuffix(route.Upstream, "/") + string(c.Request().RequestURI()))
+	if err != nil {
+		return nil, err
+	}
+	contentLength := int64(c.Request().Header.ContentLength())
+	var reqBody io.Reader = body
+	if contentLength == 0 {
+		reqBody = http.NoBody
+	}
+	req, err := http.NewRequest(c.Method(), target.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		req.Header.Add(string(key), string(value))
+	})
+	removeHopHeaders(req.Header)
+	req.Header.Del(fiber.HeaderHost)
+	req.Header.Del(fiber.HeaderContentLength)
+	// 分块传输的请求体长度未知，为 -1
+	req.ContentLength = max(contentLength, -1)
+	if route.PreserveHost {
+		req.Host = c.Hostname()
+	}
+
+	// 认证令牌不转发给上游
+	req.Header.Del("X-Arkauthn")
+	cookies := req.Cookies()
+	req.Header.Del(fiber.HeaderCookie)
+	for _, cookie := range cookies {
+		if cookie.Name != authCookieName() {
+			req.AddCookie(cookie)
+		}
+	}
+
+	for _, h := range identityHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Remote-User", userinfo.Username)
+	req.Header.Set("X-Forwarded-User", userinfo.Username)
+	if u, ok := vars.UserStore.Get(userinfo.Username); ok && len(u.Groups) > 0 {
+		req.Header.Set("Remote-Groups", strings.Join(u.Groups, ","))
+	}
+
+	clientIP := c.Context().RemoteIP().String()
+	// 只有来自 trusted_proxies 的请求保留原有的 X-Forwarded-For
+	if prior := req.Header.Get(fiber.HeaderXForwardedFor); prior != "" && len(vars.Config().TrustedProxies) > 0 && c.IsProxyTrusted() {
+		clientIP = prior + ", " + clientIP
+	}
+	req.Header.Set(fiber.HeaderXForwardedFor, clientIP)
+	req.Header.Set(fiber.HeaderXForwardedHost, c.Hostname())
+	req.Header.Set(fiber.HeaderXForwardedProto, c.Protocol())
+	return req, nil
+}
+
+// copyUpstreamResponse 将上游响应写回客户端，未知长度的响应体以分块方式边读边发送，支持 SSE 等流式响应
+func copyUpstreamResponse(c *fiber.Ctx, resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	c.Status(resp.StatusCode)
+	c.Response().Header.SetNoDefaultContentType(true)
+	for key, values := range resp.Header {
+		if key == fiber.HeaderContentLength {
+			continue
+		}
+		for _, v := range values {
+			c.Response().Header.Add(key, v)
+		}
+	}
+	if c.Method() == fiber.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if c.Method() == fiber.MethodHead && resp.ContentLength >= 0 {
+			c.Response().Header.SetContentLength(int(resp.ContentLength))
+		}
+		return
+	}
+	size := int(resp.ContentLength)
+	if resp.ContentLength < 0 {
+		size = -1
+	}
+	c.Response().SetBodyStream(resp.Body, size)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, field := range header.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+func isWebSocketUpgrade(c *fiber.Ctx) bool {
+	if !strings.EqualFold(c.Get(fiber.HeaderUpgrade), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(c.Get(fiber.HeaderConnection), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyWebSocket 转发 WebSocket 握手，上游同意升级后接管客户端连接并双向转发数据
+func proxyWebSocket(c *fiber.Ctx, req *http.Request) error {
+	upstream, err := dialUpstream(req.URL)
+	if err != nil {
+		logrus.Errorf("Proxy websocket to %s failed: %v", req.URL, err)
+		return c.SendStatus(http.StatusBadGateway)
+	}
+	req.Header.Set(fiber.HeaderConnection, "Upgrade")
+	req.Header.Set(fiber.HeaderUpgrade, "websocket")
+	if err := req.Write(upstream); err != nil {
+		upstream.Close()
+		logrus.Errorf("Proxy websocket to %s failed: %v", req.URL, err)
+		return c.SendStatus(http.StatusBadGateway)
+	}
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		upstream.Close()
+		logrus.Errorf("Proxy websocket to %s failed: %v", req.URL, err)
+		return c.SendStatus(http.StatusBadGateway)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// 上游拒绝升级，按普通响应返回，响应体读完后关闭连接
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{resp.Body, upstream}
+		copyUpstreamResponse(c, resp)
+		return nil
+	}
+
+	c.Status(http.StatusSwitchingProtocols)
+	c.Response().Header.SetNoDefaultContentType(true)
+	for key, values := range resp.Header {
+		for _, v := range values {
+			c.Response().Header.Add(key, v)
+		}
+	}
+	c.Context().Hijack(func(client net.Conn) {
+		defer upstream.Close()
+		client.SetDeadline(time.Time{})
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(upstream, client)
+			done <- struct{}{}
+		}()
+		go func() {
+			// 上游在握手响应之后立即发送的数据已经在 br 中
+			io.Copy(client, br)
+			done <- struct{}{}
+		}()
+		<-done
+	})
+	return nil
+}
+
+// dialUpstream 连接上游服务，https 上游使用 TLS
+func dialUpstream(u *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if u.Scheme == "https" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		return tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(u.Hostname(), port), &tls.Config{ServerName: u.Hostname()})
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return dialer.Dial("tcp", net.JoinHostPort(u.Hostname(), port))
+}
@@ -1,8 +1,13 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"mime"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -10,33 +15,58 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/template/html/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/i18n"
 	"github.com/zjyl1994/arkauthn/infra/utils"
 	"github.com/zjyl1994/arkauthn/infra/vars"
 	"github.com/zjyl1994/arkauthn/web"
 )
 
-const cspNonceKey = "__CSP_NONCE__"
+const (
+	cspNonceKey     = "__CSP_NONCE__"
+	langKey         = "__LANG__"
+	proxyHostKey    = "__PROXY_HOST__"
+	renewDeferKey   = "__RENEW_DEFER__"   // ForwardAuth 的页面请求，续期改为跳转到认证服务
+	renewDueKey     = "__RENEW_DUE__"     // 令牌需要续期
+	renewedTokenKey = "__RENEWED_TOKEN__" // 本次请求续期后的令牌
+)
+
+var (
+	runningMu       sync.Mutex
+	runningApp      *fiber.App
+	runningAdminAPI *fiber.App
+	runningACMEHTTP *http.Server
+	runningListener net.Listener // 未经 TLS 包装的原始监听器，用于平滑重启时传递给新进程
+)
 
 func Run(listen string) error {
 	mime.AddExtensionType(".wasm", "application/wasm")
 
-	embedAssets, err := web.GetHttpAssets()
+	embedAssets, err := web.GetHttpAssets(vars.Config().ThemeDir)
 	if err != nil {
 		return err
 	}
 
 	engine := html.NewFileSystem(embedAssets, ".html")
+	engine.AddFunc("t", i18n.T)
+	engine.AddFunc("site", siteInfo)
 	app := fiber.New(fiber.Config{
 		DisableStartupMessage:   true,
+		Immutable:               true, // 请求中的值会被保存到配置、审计日志和限流器中，不能复用底层缓冲区
 		Views:                   engine,
 		ViewsLayout:             "layout",
 		PassLocalsToViews:       true,
-		EnableTrustedProxyCheck: len(vars.Config.TrustedProxies) > 0,
-		TrustedProxies:          vars.Config.TrustedProxies,
+		EnableTrustedProxyCheck: len(vars.Config().TrustedProxies) > 0,
+		TrustedProxies:          vars.Config().TrustedProxies,
 		ProxyHeader:             fiber.HeaderXForwardedFor,
+		// 超过 BodyLimit 的请求体不会被读入内存，反向代理直接转发给上游，认证服务自身的路由由 bodyLimitMiddleware 限制
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	app.Use(recover.New())
+	app.Use(proxyMiddleware)
+	app.Use(bodyLimitMiddleware)
 
 	// Add Security Headers
 	app.Use(func(c *fiber.Ctx) error {
@@ -53,11 +83,23 @@ func Run(listen string) error {
 		return c.Next()
 	})
 
+	// 健康检查不需要语言和登录状态
+	app.Get("/healthz", healthzHandler)
+	app.Get("/readyz", readyzHandler)
+	app.Get("/version", versionHandler)
+
+	app.Use(langMiddleware)
+	// ForwardAuth 自行校验令牌，以便使用认证结果缓存
+	app.Get("/api/forward-auth", forwardAuthHandler)
 	app.Use(authTokenMiddleware)
-	app.Get("/", indexHandler)
+	csrfProtect := newCSRFMiddleware()
+	app.Get("/", csrfProtect, indexHandler)
 	app.Post("/", loginAuthnHandler)
+	app.Post("/password", csrfProtect, changePasswordHandler)
 	app.Get("/logout", logoutHandler)
-	app.Get("/api/forward-auth", forwardAuthHandler)
+	app.Get("/renew", renewHandler)
+	app.Post("/api/introspect", introspectHandler)
+	registerAdminRoutes(app, csrfProtect)
 
 	// Rate limiter for CAPTCHA endpoints
 	capLimiter := limiter.New(limiter.Config{
@@ -78,5 +120,73 @@ func Run(listen string) error {
 		Root:   embedAssets,
 		MaxAge: int((7 * 24 * time.Hour).Seconds()),
 	}))
-	return app.Listen(listen)
+
+	app.Hooks().OnListen(func(fiber.ListenData) error {
+		notifyHandoffReady()
+		notifySystemdReady()
+		return nil
+	})
+
+	ln, err := newListener(listen)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	runningMu.Lock()
+	runningApp = app
+	runningListener = ln
+	runningMu.Unlock()
+
+	if listen := vars.Config().AdminAPI.Listen; listen != "" {
+		adminAPI := newAdminAPIApp()
+		runningMu.Lock()
+		runningAdminAPI = adminAPI
+		runningMu.Unlock()
+		go func() {
+			if err := runAdminAPI(adminAPI, listen); err != nil {
+				logrus.Errorf("Admin API stopped: %v", err)
+			}
+		}()
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return app.Listener(ln)
+}
+
+// Shutdown 停止接受新连接，并在超时前等待进行中的请求处理完成
+func Shutdown(timeout time.Duration) error {
+	runningMu.Lock()
+	app, adminAPI, acmeHTTP := runningApp, runningAdminAPI, runningACMEHTTP
+	runningMu.Unlock()
+	if adminAPI != nil {
+		if err := adminAPI.ShutdownWithTimeout(timeout); err != nil {
+			logrus.Errorf("Shutdown admin api failed: %v", err)
+		}
+	}
+	if acmeHTTP != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := acmeHTTP.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			logrus.Errorf("Shutdown ACME HTTP listener failed: %v", err)
+		}
+	}
+	if app == nil {
+		return nil
+	}
+	return app.ShutdownWithTimeout(timeout)
+}
+
+// siteInfo 返回页面品牌信息，未配置站点名称时使用默认名称
+func siteInfo() vars.SiteConfig {
+	site := vars.Config().Site
+	if site.Name == "" {
+		site.Name = vars.APP_NAME
+	}
+	return site
 }
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// issueSession 为用户签发新的令牌并记录会话，host 为登录后跳转的目标域名
+// 有效期受会话策略的 max_lifetime 限制，启用滑动续期时令牌先按空闲超时签发，之后访问时续期到 dur
+func issueSession(c *fiber.Ctx, username, host string, dur time.Duration) (string, time.Time, error) {
+	policy := sessionPolicyFor(username, host)
+	dur = capLifetime(policy, dur)
+	if idle := time.Duration(policy.IdleTimeout) * time.Second; idle > 0 {
+		return newSession(c, username, min(dur, idle), dur)
+	}
+	return newSession(c, username, dur, 0)
+}
+
+// issueFixedSession 签发固定有效期、不续期的令牌，用于管理接口签发的令牌，有效期同样受用户会话策略的 max_lifetime 限制
+func issueFixedSession(c *fiber.Ctx, username string, dur time.Duration) (string, time.Time, error) {
+	return newSession(c, username, capLifetime(sessionPolicyFor(username, ""), dur), 0)
+}
+
+// capLifetime 将有效期截断到会话策略的 max_lifetime
+func capLifetime(policy vars.SessionPolicy, dur time.Duration) time.Duration {
+	if maxLifetime := time.Duration(policy.MaxLifetime) * time.Second; maxLifetime > 0 && dur > maxLifetime {
+		return maxLifetime
+	}
+	return dur
+}
+
+func newSession(c *fiber.Ctx, username string, dur, maxDur time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	session := vars.Session{
+		ID:        utils.RandToken(),
+		Username:  username,
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(dur),
+	}
+	token, err := utils.GenerateToken(username, session.ID, dur, maxDur)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if vars.SessionStore != nil {
+		vars.SessionStore.Create(session)
+	}
+	return token, session.ExpiresAt, nil
+}
+
+// renewalExpiry 计算滑动续期后的过期时间：令牌剩余有效期不足空闲超时的一半、且续期能延长有效期时返回 true
+// 续期后的过期时间不超过登录时确定的最长有效期和当前策略的 max_lifetime，按域名设置的策略只在登录时生效
+func renewalExpiry(claims *utils.Claims) (time.Time, bool) {
+	expireAt := claims.ExpiresAt.Time
+	if claims.MaxExpiresAt == nil {
+		return expireAt, false
+	}
+	policy := sessionPolicyFor(claims.Username, "")
+	idle := time.Duration(policy.IdleTimeout) * time.Second
+	if idle <= 0 || time.Until(expireAt) > idle/2 {
+		return expireAt, false
+	}
+	limit := claims.MaxExpiresAt.Time
+	if maxLifetime := time.Duration(policy.MaxLifetime) * time.Second; maxLifetime > 0 && claims.AuthTime != nil {
+		if policyLimit := claims.AuthTime.Add(maxLifetime); policyLimit.Before(limit) {
+			limit = policyLimit
+		}
+	}
+	newExpireAt := time.Now().Add(idle)
+	if newExpireAt.After(limit) {
+		newExpireAt = limit
+	}
+	return newExpireAt, newExpireAt.After(expireAt)
+}
+
+// renewSession 滑动续期：需要续期时重新签发 Cookie，返回新的过期时间
+// ForwardAuth 的页面请求不在响应中写入 Cookie，只标记需要续期，由 forwardAuthHandler 跳转到认证服务续期
+func renewSession(c *fiber.Ctx, claims *utils.Claims) time.Time {
+	expireAt := claims.ExpiresAt.Time
+	newExpireAt, ok := renewalExpiry(claims)
+	if !ok {
+		return expireAt
+	}
+	if deferred, _ := c.Locals(renewDeferKey).(bool); deferred {
+		c.Locals(renewDueKey, true)
+		return expireAt
+	}
+	token, err := utils.RenewToken(claims, newExpireAt)
+	if err != nil {
+		logrus.Errorf("Renew session for %s failed: %v", claims.Username, err)
+		return expireAt
+	}
+	if _, err := setAuthCookie(c, token, newExpireAt); err != nil {
+		logrus.Errorf("Renew session for %s failed: %v", claims.Username, err)
+		return expireAt
+	}
+	c.Locals(renewedTokenKey, token)
+	if vars.SessionStore != nil {
+		vars.SessionStore.Extend(claims.ID, newExpireAt)
+	}
+	logrus.Debugf("Session %s of %s renewed until %s", claims.ID, claims.Username, newExpireAt)
+	return newExpireAt
+}
+
+// cookieToken 返回 Cookie 中的令牌，本次请求中续期过时返回续期后的令牌
+func cookieToken(c *fiber.Ctx) string {
+	if token, ok := c.Locals(renewedTokenKey).(string); ok {
+		return token
+	}
+	return c.Cookies(authCookieName())
+}
+
+// renewHandler 由 ForwardAuth 跳转而来，authTokenMiddleware 已经续期认证服务域名下的 Cookie，跳转回原页面
+// 跨域站点的 Cookie 通过授权码换成续期后的令牌
+func renewHandler(c *fiber.Ctx) error {
+	redirect := c.Query("r")
+	if _, ok := c.Locals(authUserKey).(authUserType); !ok {
+		return redirectToLogin(c, redirect)
+	}
+	if token := cookieToken(c); token != "" {
+		if target, ok := crossDomainTarget(redirect); ok {
+			return c.Redirect(ssoRedirect(target, token), fiber.StatusSeeOther)
+		}
+	}
+	rootDomain, err := utils.ExtractRootDomain(vars.Config().Redirect)
+	if err == nil && redirect != "" && isSafeRedirect(redirect, rootDomain) {
+		return c.Redirect(redirect, fiber.StatusSeeOther)
+	}
+	return c.Redirect("/", fiber.StatusSeeOther)
+}
+
+// defaultSessionDurations 未配置 durations 时登录页可选的时长：1小时、1天、30天、1年
+var defaultSessionDurations = []int{3600, 86400, 2592000, 31536000}
+
+// sessionPolicyFor 返回用户登录到目标域名时生效的会话策略，host 为空时不匹配按域名设置的策略
+// 不含 hosts 的策略按 用户组 < 用户 的顺序依次覆盖，同一级别靠前的策略优先，策略中未设置的字段使用全局值，-1 表示不启用
+// 目标域名来自用户可控的跳转地址，而 Cookie 对根域名下所有站点有效，因此含 hosts 的策略只能收紧限制，见 tightenSessionPolicy
+func sessionPolicyFor(username, host string) vars.SessionPolicy {
+	conf := vars.Config().Session
+	result := vars.SessionPolicy{
+		IdleTimeout:     conf.IdleTimeout,
+		MaxLifetime:     conf.MaxLifetime,
+		Durations:       conf.Durations,
+		DefaultDuration: conf.DefaultDuration,
+	}
+	var groups []string
+	if username != "" && vars.UserStore != nil {
+		if u, ok := vars.UserStore.Get(username); ok {
+			groups = u.Groups
+		}
+	}
+	type matched struct {
+		index, rank int
+	}
+	var matches []matched
+	var hostMatches []int
+	for i, p := range conf.Policies {
+		rank := 0
+		if len(p.Users) > 0 {
+			if !slices.Contains(p.Users, username) {
+				continue
+			}
+			rank += 2
+		}
+		if len(p.Groups) > 0 {
+			if !slices.ContainsFunc(p.Groups, func(g string) bool { return slices.Contains(groups, g) }) {
+				continue
+			}
+			rank++
+		}
+		if len(p.Hosts) > 0 {
+			if host == "" || !slices.ContainsFunc(p.Hosts, func(d string) bool { return utils.MatchDomain(host, d) }) {
+				continue
+			}
+			hostMatches = append(hostMatches, i)
+			continue
+		}
+		if rank > 0 {
+			matches = append(matches, matched{i, rank})
+		}
+	}
+	// 优先级低的先应用，后应用的覆盖先应用的
+	slices.SortFunc(matches, func(a, b matched) int {
+		if a.rank != b.rank {
+			return a.rank - b.rank
+		}
+		return b.index - a.index
+	})
+	for _, m := range matches {
+		p := conf.Policies[m.index]
+		if p.IdleTimeout != 0 {
+			result.IdleTimeout = p.IdleTimeout
+		}
+		if p.MaxLifetime != 0 {
+			result.MaxLifetime = p.MaxLifetime
+		}
+		if len(p.Durations) > 0 {
+			result.Durations = p.Durations
+		}
+		if p.DefaultDuration != 0 {
+			result.DefaultDuration = p.DefaultDuration
+		}
+	}
+	for _, i := range hostMatches {
+		result = tightenSessionPolicy(result, conf.Policies[i])
+	}
+	return result
+}
+
+// tightenSessionPolicy 应用按域名设置的策略，只取更严格的值：
+// idle_timeout 和 max_lifetime 取较小的正数，-1 不能关闭限制；
+// durations 替换可选项，但 max_lifetime 不超过应用前可选的最长时长，因此登录时长不会超过不经过该域名登录时的上限
+func tightenSessionPolicy(base, p vars.SessionPolicy) vars.SessionPolicy {
+	result := base
+	if p.IdleTimeout > 0 && (result.IdleTimeout <= 0 || p.IdleTimeout < result.IdleTimeout) {
+		result.IdleTimeout = p.IdleTimeout
+	}
+	limit := p.MaxLifetime
+	if len(p.Durations) > 0 {
+		options, _ := loginDurations(base)
+		if longest := slices.Max(options); limit <= 0 || longest < limit {
+			limit = longest
+		}
+		result.Durations = p.Durations
+	}
+	if limit > 0 && (result.MaxLifetime <= 0 || limit < result.MaxLifetime) {
+		result.MaxLifetime = limit
+	}
+	if p.DefaultDuration != 0 {
+		result.DefaultDuration = p.DefaultDuration
+	}
+	return result
+}
+
+// loginDurations 返回策略下登录页可选的时长和默认时长，单位秒，超过 max_lifetime 的选项不展示
+func loginDurations(policy vars.SessionPolicy) ([]int, int) {
+	durations := policy.Durations
+	if len(durations) == 0 {
+		durations = defaultSessionDurations
+	}
+	var options []int
+	for _, d := range durations {
+		if policy.MaxLifetime <= 0 || d <= policy.MaxLifetime {
+			options = append(options, d)
+		}
+	}
+	if len(options) == 0 {
+		options = []int{policy.MaxLifetime}
+	}
+	if slices.Contains(options, policy.DefaultDuration) {
+		return options, policy.DefaultDuration
+	}
+	return options, options[0]
+}
+
+// resolveLoginDuration 校验用户提交的登录时长，不在可选范围内时使用默认时长，超过 max_lifetime 时截断
+func resolveLoginDuration(policy vars.SessionPolicy, duration int) int {
+	durations := policy.Durations
+	if len(durations) == 0 {
+		durations = defaultSessionDurations
+	}
+	if !slices.Contains(durations, duration) {
+		_, duration = loginDurations(policy)
+	}
+	if policy.MaxLifetime > 0 && duration > policy.MaxLifetime {
+		duration = policy.MaxLifetime
+	}
+	return duration
+}
+
+// redirectHost 返回登录后跳转目标的主机名，站内相对路径返回空
+func redirectHost(redirect string) string {
+	if redirect == "" || (strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//")) {
+		return ""
+	}
+	if strings.HasPrefix(redirect, "//") {
+		redirect = "https:" + redirect
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func isSessionRevoked(id string) bool {
+	return id != "" && vars.SessionStore != nil && vars.SessionStore.IsRevoked(id)
+}
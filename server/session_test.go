@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func TestForwardAuthRenewal(t *testing.T) {
+	conf := testProxyConfig()
+	conf.Session.IdleTimeout = 3600
+	setupTestConfig(t, conf)
+	app := fiber.New()
+	app.Get("/api/forward-auth", forwardAuthHandler)
+	app.Use(authTokenMiddleware)
+	app.Get("/renew", renewHandler)
+
+	// 剩余有效期不足空闲超时的一半，需要续期
+	token, err := utils.GenerateToken("alice", "s1", 10*time.Minute, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const target = "https://app.example.com/page?a=1"
+
+	tests := []struct {
+		name         string
+		fetchMode    string
+		wantStatus   int
+		wantLocation string
+		wantCookie   bool
+	}{
+		// 页面请求跳转到认证服务续期，不依赖反向代理转发 Set-Cookie
+		{"navigation", "navigate", http.StatusSeeOther, "https://auth.example.com/renew?r=" + url.QueryEscape(target), false},
+		// 其他请求只能在响应中写入 Cookie
+		{"fetch", "cors", http.StatusNoContent, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/forward-auth", nil)
+			req.Header.Set("X-Forwarded-Method", "GET")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "app.example.com")
+			req.Header.Set("X-Forwarded-Uri", "/page?a=1")
+			req.Header.Set("Sec-Fetch-Mode", tt.fetchMode)
+			req.AddCookie(&http.Cookie{Name: authCookieName(), Value: token})
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get(fiber.HeaderLocation); got != tt.wantLocation {
+				t.Errorf("location = %q, want %q", got, tt.wantLocation)
+			}
+			if got := len(resp.Cookies()) > 0; got != tt.wantCookie {
+				t.Errorf("set cookie = %v, want %v", got, tt.wantCookie)
+			}
+		})
+	}
+
+	t.Run("renew", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://auth.example.com/renew?r="+url.QueryEscape(target), nil)
+		req.RequestURI = ""
+		req.AddCookie(&http.Cookie{Name: authCookieName(), Value: token})
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get(fiber.HeaderLocation) != target {
+			t.Fatalf("status = %d location = %q, want %d %q", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation), http.StatusSeeOther, target)
+		}
+		cookies := resp.Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("cookies = %v, want renewed cookie", cookies)
+		}
+		claims, err := utils.ParseToken(cookies[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Until(claims.ExpiresAt.Time) < 59*time.Minute {
+			t.Errorf("renewed token expires at %s, want about one hour later", claims.ExpiresAt.Time)
+		}
+	})
+}
+
+// 跳转地址由用户提交，按域名设置的策略不能延长会话
+func TestSessionPolicyHostsOnlyTighten(t *testing.T) {
+	conf := testProxyConfig()
+	conf.Users = append(conf.Users, vars.UserItem{Username: "bob", Password: "x", Groups: []string{"admins"}})
+	conf.Session = vars.SessionConfig{
+		IdleTimeout: 3600,
+		Durations:   []int{3600, 86400},
+		Policies: []vars.SessionPolicy{
+			{Groups: []string{"admins"}, MaxLifetime: 3600},
+			{Hosts: []string{"kiosk.example.com"}, IdleTimeout: -1, Durations: []int{86400, 2592000}, DefaultDuration: 2592000},
+			{Hosts: []string{"example.com"}, IdleTimeout: 600},
+		},
+	}
+	setupTestConfig(t, conf)
+
+	tests := []struct {
+		name         string
+		username     string
+		host         string
+		duration     int
+		wantDuration int
+		wantIdle     int
+	}{
+		{"no host", "alice", "", 2592000, 3600, 3600},
+		{"kiosk cannot extend", "alice", "kiosk.example.com", 2592000, 86400, 600},
+		{"kiosk cannot extend group limit", "bob", "kiosk.example.com", 86400, 3600, 600},
+		{"stricter idle timeout", "alice", "app.example.com", 86400, 86400, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := sessionPolicyFor(tt.username, tt.host)
+			if got := resolveLoginDuration(policy, tt.duration); got != tt.wantDuration {
+				t.Errorf("duration = %d, want %d", got, tt.wantDuration)
+			}
+			if policy.IdleTimeout != tt.wantIdle {
+				t.Errorf("idle timeout = %d, want %d", policy.IdleTimeout, tt.wantIdle)
+			}
+		})
+	}
+}
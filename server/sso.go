@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+const (
+	defaultSSOCallbackPath = "/_arkauthn/callback"
+	ssoCodeTTL             = time.Minute
+)
+
+// ssoCode 跨域登录的一次性授权码，只保存在内存中
+type ssoCode struct {
+	token     string
+	host      string
+	redirect  string
+	expiresAt time.Time
+}
+
+var ssoCodes = struct {
+	sync.Mutex
+	m map[string]ssoCode
+}{m: make(map[string]ssoCode)}
+
+func ssoCallbackPath() string {
+	if p := vars.Config().CrossDomain.CallbackPath; p != "" {
+		return p
+	}
+	return defaultSSOCallbackPath
+}
+
+// crossDomainTarget 判断跳转目标是否为需要跨域登录的站点：不在 Cookie 的域名范围内，且与认证服务属于同一根域名、在 trusted_domains 中或是反向代理的域名
+func crossDomainTarget(redirect string) (*url.URL, bool) {
+	if !vars.Config().CrossDomain.Enabled || redirect == "" {
+		return nil, false
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, false
+	}
+	host := strings.ToLower(u.Hostname())
+	if cookieCoversHost(host) {
+		return nil, false
+	}
+	if rootDomain, err := utils.ExtractRootDomain(vars.Config().Redirect); err == nil && utils.MatchDomain(host, rootDomain) {
+		return u, true
+	}
+	trusted := slices.ContainsFunc(vars.Config().TrustedDomains, func(domain string) bool {
+		return utils.MatchDomain(host, domain)
+	})
+	if _, proxied := proxyRouteFor(host); proxied {
+		trusted = true
+	}
+	return u, trusted
+}
+
+// ssoRedirect 为已登录的用户签发一次性授权码，返回目标站点的回调地址
+func ssoRedirect(target *url.URL, token string) string {
+	code := utils.RandToken()
+	now := time.Now()
+	ssoCodes.Lock()
+	for k, v := range ssoCodes.m {
+		if now.After(v.expiresAt) {
+			delete(ssoCodes.m, k)
+		}
+	}
+	ssoCodes.m[code] = ssoCode{
+		token:     token,
+		host:      strings.ToLower(target.Hostname()),
+		redirect:  target.String(),
+		expiresAt: now.Add(ssoCodeTTL),
+	}
+	ssoCodes.Unlock()
+	callback := url.URL{Scheme: target.Scheme, Host: target.Host, Path: ssoCallbackPath()}
+	callback.RawQuery = url.Values{"code": {code}}.Encode()
+	return callback.String()
+}
+
+// ssoCallback 处理 ForwardAuth 转发的回调请求，用授权码换取目标站点域名下的 Cookie 后跳转回原地址
+func ssoCallback(c *fiber.Ctx, forwardUri *url.URL) error {
+	code := forwardUri.Query().Get("code")
+	host := strings.ToLower(forwardUri.Hostname())
+	ssoCodes.Lock()
+	entry, ok := ssoCodes.m[code]
+	delete(ssoCodes.m, code)
+	ssoCodes.Unlock()
+	if !ok || time.Now().After(entry.expiresAt) || entry.host != host {
+		logrus.Warnf("Invalid SSO code for %s from %s", host, c.IP())
+		return renderError(c, fiber.StatusBadRequest, "error.invalid_sso_code")
+	}
+	// 签发授权码之后站点可能已经从 trusted_domains 中移除
+	if _, ok := crossDomainTarget(entry.redirect); !ok {
+		logrus.Warnf("SSO code for untrusted host %s from %s", host, c.IP())
+		return renderError(c, fiber.StatusBadRequest, "error.invalid_sso_code")
+	}
+	claims, err := utils.ParseToken(entry.token)
+	if err != nil || isSessionRevoked(claims.ID) {
+		return renderError(c, fiber.StatusBadRequest, "error.invalid_sso_code")
+	}
+	if _, err := setAuthCookie(c, entry.token, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+	recordAudit(c, auditSSOLogin, claims.Username, "host="+host)
+	return c.Redirect(entry.redirect, fiber.StatusSeeOther)
+}
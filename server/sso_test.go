@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+func TestSSOCallbackTrustedDomainRemoved(t *testing.T) {
+	setupTestConfig(t, testProxyConfig())
+	app := fiber.New()
+	app.Get("/api/forward-auth", forwardAuthHandler)
+
+	tests := []struct {
+		name    string
+		trusted []string
+		wantOK  bool
+	}{
+		{"trusted", []string{"other.net"}, true},
+		// 授权码签发之后站点被移出 trusted_domains
+		{"removed", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := *vars.Config()
+			conf.TrustedDomains = []string{"other.net"}
+			vars.SetConfig(conf)
+			code := addTestSSOCode(t, "app.other.net")
+			conf.TrustedDomains = tt.trusted
+			vars.SetConfig(conf)
+			req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1/api/forward-auth", nil)
+			req.Header.Set("X-Forwarded-Method", "GET")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "app.other.net")
+			req.Header.Set("X-Forwarded-Uri", ssoCallbackPath()+"?code="+code)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.StatusCode == http.StatusSeeOther; got != tt.wantOK {
+				t.Errorf("status = %d, want redirect %v", resp.StatusCode, tt.wantOK)
+			}
+			if got := len(resp.Cookies()) > 0; got != tt.wantOK {
+				t.Errorf("cookie set = %v, want %v", got, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// certReloadInterval 静态证书文件变更检查间隔
+	certReloadInterval        = 10 * time.Second
+	acmeHTTPReadHeaderTimeout = 10 * time.Second
+)
+
+// newTLSConfig 根据配置构建 TLS 配置，未启用 TLS 时返回 nil
+func newTLSConfig() (*tls.Config, error) {
+	conf := vars.Config().TLS
+	if conf.ACME.Enabled {
+		return newACMETLSConfig(conf.ACME)
+	}
+	if conf.CertFile == "" && conf.KeyFile == "" {
+		return nil, nil
+	}
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, errors.New("tls cert_file and key_file must be set together")
+	}
+	reloader, err := newCertReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+func newACMETLSConfig(conf vars.ACMEConfig) (*tls.Config, error) {
+	if len(conf.Domains) == 0 {
+		return nil, errors.New("acme domains is required")
+	}
+	cacheDir := conf.CacheDir
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.Domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      conf.Email,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// 测试环境（如 Pebble）使用自签名根证书
+	if conf.CARoot != "" {
+		pem, err := os.ReadFile(conf.CARoot)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CARoot)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	manager.Client = &acme.Client{
+		DirectoryURL: conf.DirectoryURL, // 为空时使用 Let's Encrypt
+		HTTPClient:   &http.Client{Transport: &orderLocationTransport{base: transport, orders: make(map[string]string)}},
+	}
+	// 配置了 HTTP 监听时同时支持 HTTP-01，否则仅使用 TLS-ALPN-01
+	if conf.HTTPListen != "" {
+		srv := &http.Server{
+			Handler:           manager.HTTPHandler(nil),
+			ReadHeaderTimeout: acmeHTTPReadHeaderTimeout,
+		}
+		runningMu.Lock()
+		runningACMEHTTP = srv
+		runningMu.Unlock()
+		go func() {
+			if err := runACMEHTTP(srv, conf.HTTPListen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Errorf("ACME HTTP listener stopped: %v", err)
+			}
+		}()
+	}
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig, nil
+}
+
+// runACMEHTTP 运行 HTTP-01 验证和跳转 HTTPS 的监听器
+// 该监听器不随平滑重启传递，新进程等待旧进程关闭后再绑定端口
+func runACMEHTTP(srv *http.Server, listen string) error {
+	ln, err := listenWithRetry(listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infoln("ACME HTTP-01 challenge listening in", listen)
+	return srv.Serve(ln)
+}
+
+// orderLocationTransport 为没有 Location 的 finalize 响应补上订单地址
+// CA 异步签发证书时（如 Pebble）finalize 返回 processing 状态的订单，autocert 使用响应的 Location 轮询订单，没有时请求空地址而失败
+type orderLocationTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	orders map[string]string // finalize 地址 -> 订单地址
+}
+
+func (t *orderLocationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	// finalize 的响应，无论是否带有 Location 都删除记录
+	t.mu.Lock()
+	orderURL, isFinalize := t.orders[req.URL.String()]
+	delete(t.orders, req.URL.String())
+	t.mu.Unlock()
+	location := resp.Header.Get("Location")
+	if isFinalize {
+		if location == "" {
+			resp.Header.Set("Location", orderURL)
+		}
+		return resp, nil
+	}
+	if location == "" {
+		return resp, nil
+	}
+	// 新建订单的响应，记录 finalize 地址对应的订单地址
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		t.mu.Lock()
+		t.orders[order.Finalize] = location
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// certReloader 在证书文件更新后自动重新加载，无需重启服务
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	st, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = st.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	needCheck := time.Since(r.checkedAt) > certReloadInterval
+	if needCheck {
+		r.checkedAt = time.Now()
+	}
+	modTime := r.modTime
+	r.mu.Unlock()
+
+	if needCheck {
+		if st, err := os.Stat(r.certFile); err == nil && !st.ModTime().Equal(modTime) {
+			if err := r.load(); err != nil {
+				// 新证书可能还未写完，继续使用旧证书
+				logrus.Errorf("Reload TLS certificate failed: %v", err)
+			} else {
+				logrus.Infoln("TLS certificate reloaded from", r.certFile)
+			}
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,91 @@
+//go:build pebble
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// TestACMEPebble 向本地的 Pebble 申请证书，需要先在 Pebble 源码目录启动 Pebble 和用于解析域名的 pebble-challtestsrv：
+//
+//	pebble-challtestsrv -defaultIPv6 "" -http01 "" -https01 "" -tlsalpn01 "" -doh ""
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	PEBBLE_CA_ROOT=/path/to/pebble/test/certs/pebble.minica.pem go test -tags pebble -run TestACMEPebble ./server/
+//
+// 域名默认为 arkauthn.test，解析到 127.0.0.1，Pebble 通过 tlsPort 5001（TLS-ALPN-01）和 httpPort 5002（HTTP-01）校验
+func TestACMEPebble(t *testing.T) {
+	caRoot := os.Getenv("PEBBLE_CA_ROOT")
+	if caRoot == "" {
+		t.Skip("PEBBLE_CA_ROOT is not set")
+	}
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY")
+	if directoryURL == "" {
+		directoryURL = "https://localhost:14000/dir"
+	}
+	domain := os.Getenv("PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "arkauthn.test"
+	}
+
+	tlsConfig, err := newACMETLSConfig(vars.ACMEConfig{
+		Enabled:      true,
+		Domains:      []string{domain},
+		CacheDir:     t.TempDir(),
+		DirectoryURL: directoryURL,
+		CARoot:       caRoot,
+		HTTPListen:   "127.0.0.1:5002",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(tlsConfig.NextProtos, "acme-tls/1") {
+		t.Errorf("NextProtos = %v, want acme-tls/1 for TLS-ALPN-01", tlsConfig.NextProtos)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:5001", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	// 首次握手时签发证书
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(leaf.DNSNames, domain) {
+		t.Errorf("certificate DNSNames = %v, want %s", leaf.DNSNames, domain)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		t.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+
+	// 不在 domains 中的域名不申请证书
+	if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other." + domain}); err == nil {
+		t.Error("GetCertificate() for a host outside domains should fail")
+	}
+}
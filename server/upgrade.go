@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zjyl1994/arkauthn/infra/utils"
+	"github.com/zjyl1994/arkauthn/infra/vars"
+)
+
+// handoffReadyTimeout 等待新进程就绪的最长时间
+const handoffReadyTimeout = 30 * time.Second
+
+var (
+	handoffReadyEnv = vars.APP_NAME + "_READY_FD"
+	handoffDoneEnv  = vars.APP_NAME + "_PARENT_DONE_FD"
+)
+
+var (
+	handoffDone   *os.File // 旧进程持有的管道写端，关闭后新进程合并旧进程保存的状态
+	stateReloader func() error
+)
+
+// SetStateReloader 设置重新读取状态文件的方法，平滑重启的新进程在旧进程退出后调用
+func SetStateReloader(fn func() error) {
+	stateReloader = fn
+}
+
+// Handoff 启动新的进程并将监听器传递给它，新进程就绪后返回
+// 调用方随后应平滑关闭当前进程，期间连接由内核队列保持，不会丢失
+func Handoff() error {
+	runningMu.Lock()
+	ln := runningListener
+	runningMu.Unlock()
+	if ln == nil {
+		return errors.New("server is not running")
+	}
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("listener %T does not support handoff", ln)
+	}
+	lnFile, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	doneReader, doneWriter, err := os.Pipe()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	defer doneReader.Close()
+
+	// 使用 os.Args[0] 而不是 os.Executable，以便执行升级后的新二进制文件
+	binary, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		readyWriter.Close()
+		doneWriter.Close()
+		return err
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, readyWriter, doneReader} // fd 3, fd 4, fd 5
+	cmd.Env = append(os.Environ(),
+		vars.APP_NAME+"_LISTEN_FDS=1",
+		handoffReadyEnv+"="+strconv.Itoa(utils.SdListenFdsStart+1),
+		handoffDoneEnv+"="+strconv.Itoa(utils.SdListenFdsStart+2),
+	)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		doneWriter.Close()
+		return err
+	}
+	go cmd.Wait()
+
+	readyCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyReader.Read(buf)
+		readyCh <- err
+	}()
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("new process exited before ready")
+			}
+			doneWriter.Close()
+			return err
+		}
+	case <-time.After(handoffReadyTimeout):
+		cmd.Process.Kill()
+		doneWriter.Close()
+		return errors.New("timeout waiting for new process")
+	}
+	handoffDone = doneWriter
+
+	// 新进程接管 socket 文件，关闭时不能删除
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	if _, err := utils.SdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid)); err != nil {
+		logrus.Warnf("sd_notify MAINPID failed: %v", err)
+	}
+	logrus.Infof("Listener handed off to new process %d", cmd.Process.Pid)
+	return nil
+}
+
+// FinishHandoff 旧进程处理完剩余请求并保存状态后调用，通知新进程合并状态文件
+func FinishHandoff() {
+	if handoffDone != nil {
+		handoffDone.Close()
+		handoffDone = nil
+	}
+}
+
+// notifyHandoffReady 通知发起平滑重启的旧进程：新进程已开始监听
+// 旧进程在交接后仍会处理剩余的请求，等它退出后重新读取状态文件，合并期间的吊销和登录失败记录
+func notifyHandoffReady() {
+	fdStr := os.Getenv(handoffReadyEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(handoffReadyEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		logrus.Warnf("Notify handoff ready failed: %v", err)
+	}
+	waitParentDone()
+}
+
+// waitParentDone 在后台等待旧进程关闭管道（FinishHandoff 或退出），然后重新读取状态文件
+func waitParentDone() {
+	fdStr := os.Getenv(handoffDoneEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(handoffDoneEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "handoff-done")
+	go func() {
+		defer f.Close()
+		io.Copy(io.Discard, f)
+		if stateReloader == nil {
+			return
+		}
+		if err := stateReloader(); err != nil {
+			logrus.Errorf("Reload state after handoff failed: %v", err)
+			return
+		}
+		logrus.Infoln("State merged from previous process")
+	}()
+}
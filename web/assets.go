@@ -2,17 +2,105 @@ package web
 
 import (
 	"embed"
+	"errors"
+	"io"
 	"io/fs"
 	"net/http"
+	"os"
+	"sort"
 )
 
 //go:embed public
 var publicFiles embed.FS
 
-func GetHttpAssets() (http.FileSystem, error) {
+// GetHttpAssets 返回内嵌的静态资源与模板
+// themeDir 不为空时，目录中的同名文件会覆盖内嵌文件
+func GetHttpAssets(themeDir string) (http.FileSystem, error) {
 	f, err := fs.Sub(publicFiles, "public")
 	if err != nil {
 		return nil, err
 	}
-	return http.FS(f), nil
+	if themeDir == "" {
+		return http.FS(f), nil
+	}
+	st, err := os.Stat(themeDir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, errors.New("theme_dir is not a directory: " + themeDir)
+	}
+	return http.FS(&overlayFS{upper: os.DirFS(themeDir), lower: f}), nil
+}
+
+// overlayFS 优先从 upper 读取文件，不存在时回退到 lower
+// 目录内容为两者合并后的结果，以便模板引擎能遍历到所有模板
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.upper.Open(name); err == nil {
+		if st, err := f.Stat(); err == nil && !st.IsDir() {
+			return f, nil
+		}
+		f.Close()
+	}
+	f, err := o.lower.Open(name)
+	if err != nil {
+		// 目录或文件仅存在于主题目录中
+		return o.upper.Open(name)
+	}
+	st, err := f.Stat()
+	if err != nil || !st.IsDir() {
+		return f, err
+	}
+	return &overlayDir{File: f, fsys: o, name: name}, nil
+}
+
+type overlayDir struct {
+	fs.File
+	fsys    *overlayFS
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		merged := make(map[string]fs.DirEntry)
+		lower, err := fs.ReadDir(d.fsys.lower, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range lower {
+			merged[e.Name()] = e
+		}
+		// 主题目录中不存在对应子目录属于正常情况
+		upper, _ := fs.ReadDir(d.fsys.upper, d.name)
+		for _, e := range upper {
+			if _, ok := merged[e.Name()]; !ok || !e.IsDir() {
+				merged[e.Name()] = e
+			}
+		}
+		d.entries = make([]fs.DirEntry, 0, len(merged))
+		for _, e := range merged {
+			d.entries = append(d.entries, e)
+		}
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	}
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
 }